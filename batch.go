@@ -0,0 +1,182 @@
+package websocket
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// frameBuffers collects frames for a single vectored write (writev on TCP sockets).
+// Headers and small payloads are copied into pooled chunks, payloads larger than
+// write buffer are referenced as is.
+type frameBuffers struct {
+	bufs   net.Buffers
+	out    net.Buffers // consumed by WriteTo, bufs keeps the slice for reuse
+	chunk  []byte      // current chunk, its tail since mark is not in bufs yet
+	mark   int
+	size   int
+	pooled [][]byte // chunks and compressed payloads, returned to the pool after write
+}
+
+var frameBuffersPool = sync.Pool{
+	New: func() interface{} {
+		return new(frameBuffers)
+	},
+}
+
+func getFrameBuffers(size int) *frameBuffers {
+	fb := frameBuffersPool.Get().(*frameBuffers)
+	fb.size = size
+	return fb
+}
+
+func putFrameBuffers(fb *frameBuffers) {
+	for i, b := range fb.pooled {
+		putBuffer(b)
+		fb.pooled[i] = nil
+	}
+	// do not keep caller's payloads
+	for i := range fb.bufs {
+		fb.bufs[i] = nil
+	}
+	fb.bufs = fb.bufs[:0]
+	fb.out = nil
+	fb.pooled = fb.pooled[:0]
+	fb.chunk = nil
+	fb.mark = 0
+	frameBuffersPool.Put(fb)
+}
+
+// reserve returns n bytes at the end of current chunk, new chunk is taken if they do not fit
+func (fb *frameBuffers) reserve(n int) []byte {
+	l := len(fb.chunk)
+	if l+n > cap(fb.chunk) {
+		fb.cut()
+		size := fb.size
+		if n > size {
+			size = n
+		}
+		fb.chunk = getBuffer(size)[:0]
+		fb.pooled = append(fb.pooled, fb.chunk)
+		fb.mark = 0
+		l = 0
+	}
+	fb.chunk = fb.chunk[:l+n]
+	return fb.chunk[l:]
+}
+
+// cut moves filled tail of the chunk to bufs
+func (fb *frameBuffers) cut() {
+	if len(fb.chunk) > fb.mark {
+		fb.bufs = append(fb.bufs, fb.chunk[fb.mark:])
+		fb.mark = len(fb.chunk)
+	}
+}
+
+// add appends frame with payload body, masked payload is always copied
+func (fb *frameBuffers) add(f *Frame, body []byte) error {
+	var hdr [14]byte
+	h := f.encodeHeader(&hdr)
+	if f.Mask {
+		var err error
+		if h, err = f.maskHeader(h); err != nil {
+			return err
+		}
+	}
+	copy(fb.reserve(len(h)), h)
+	switch {
+	case f.Mask:
+		b := fb.reserve(len(body))
+		for i := range body {
+			b[i] = body[i] ^ f.Key[i%4]
+		}
+	case len(body) > fb.size:
+		fb.cut()
+		fb.bufs = append(fb.bufs, body)
+	default:
+		copy(fb.reserve(len(body)), body)
+	}
+	f.shard.outFrame(f.Opcode)
+	return nil
+}
+
+func (fb *frameBuffers) len() int {
+	n := 0
+	for _, b := range fb.bufs {
+		n += len(b)
+	}
+	return n + len(fb.chunk) - fb.mark
+}
+
+// writeTo writes collected frames to w
+func (fb *frameBuffers) writeTo(w io.Writer) (err error) {
+	fb.cut()
+	fb.out = fb.bufs
+	if wws, ok := w.(*WriterWithStats); ok {
+		_, err = wws.writeBuffers(&fb.out)
+	} else {
+		_, err = fb.out.WriteTo(w)
+	}
+	return
+}
+
+// SendBatch writes messages as single frames with one vectored write, it is safe for concurrent use.
+// Frames of other goroutines do not get between the batch ones. Messages following close one are not sent.
+func (wsc *Connection) SendBatch(msgs []*Message) error {
+	data := false
+	for _, msg := range msgs {
+		data = data || msg.Opcode == OPCODE_TEXT || msg.Opcode == OPCODE_BINARY
+	}
+	if data {
+		wsc.msgMu.Lock()
+		defer wsc.msgMu.Unlock()
+	}
+	wsc.wmu.Lock()
+	defer wsc.wmu.Unlock()
+	if wsc.hasState(stateWriteBroken) {
+		return ErrConnectionBroken
+	}
+	if wsc.hasState(stateCloseSent | stateClosed) {
+		return ErrConnectionClosed
+	}
+	fb := getFrameBuffers(wsc.config.WsWriteBuffer)
+	defer putFrameBuffers(fb)
+	var closeMsg *Message
+	n := 0
+	for _, msg := range msgs {
+		f, body, err := wsc.prepareFrame(msg)
+		if err != nil {
+			return err
+		}
+		if f.Rsv1 {
+			fb.pooled = append(fb.pooled, body)
+		}
+		if err := fb.add(&f, body); err != nil {
+			return err
+		}
+		n++
+		if msg.Opcode == OPCODE_CLOSE {
+			closeMsg = msg
+			break
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	if err := wsc.flushWriter(); err != nil {
+		return err
+	}
+	if err := fb.writeTo(wsc.dst); err != nil {
+		return err
+	}
+	if wsc.LogLevel >= LOG_DEBUG {
+		wsc.LogDebug("batch sent: %d frames, %d bytes", n, fb.len())
+	}
+	if closeMsg != nil {
+		wsc.sentClose(closeMsg)
+		if n < len(msgs) {
+			return ErrConnectionClosed
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package websocket
+
+import (
+	"bufio"
+	"io"
+	"math/bits"
+	"sync"
+)
+
+// Pooled byte buffers in power of two size classes.
+// Larger buffers are allocated as usual and left to GC.
+
+const (
+	minBufferBits = 8  // 256 bytes
+	maxBufferBits = 22 // 4M
+)
+
+var bufferPools [maxBufferBits - minBufferBits + 1]sync.Pool
+
+// empty *[]byte holders, so that putting buffer to the pool does not allocate
+var bufferBoxes sync.Pool
+
+func bufferClass(n int) int {
+	if n <= 1<<minBufferBits {
+		return 0
+	}
+	c := bits.Len(uint(n-1)) - minBufferBits
+	if c >= len(bufferPools) {
+		return -1
+	}
+	return c
+}
+
+// getBuffer returns slice of length n
+func getBuffer(n int) []byte {
+	c := bufferClass(n)
+	if c < 0 {
+		return make([]byte, n)
+	}
+	if box, ok := bufferPools[c].Get().(*[]byte); ok {
+		b := (*box)[:n]
+		*box = nil
+		bufferBoxes.Put(box)
+		return b
+	}
+	return make([]byte, n, 1<<(c+minBufferBits))
+}
+
+// putBuffer returns buffer to the pool, buffers of foreign size are ignored
+func putBuffer(b []byte) {
+	c := bufferClass(cap(b))
+	if c < 0 || cap(b) != 1<<(c+minBufferBits) {
+		return
+	}
+	box, ok := bufferBoxes.Get().(*[]byte)
+	if !ok {
+		box = new([]byte)
+	}
+	*box = b[:0]
+	bufferPools[c].Put(box)
+}
+
+// growBuffer extends b by n bytes, contents are moved to larger pooled buffer if needed
+func growBuffer(b []byte, n int) []byte {
+	l := len(b)
+	if l+n <= cap(b) {
+		return b[:l+n]
+	}
+	nb := getBuffer(l + n)
+	copy(nb, b)
+	putBuffer(b)
+	return nb
+}
+
+// readBuffer reads r till EOF into pooled buffer, at most limit bytes
+func readBuffer(r io.Reader, hint, limit int) ([]byte, error) {
+	b := getBuffer(hint)[:0]
+	for {
+		if len(b) == cap(b) {
+			b = growBuffer(b, cap(b))[:len(b)]
+		}
+		n, err := r.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+		if len(b) > limit {
+			putBuffer(b)
+			return nil, ErrMessageTooLarge
+		}
+		if err == io.EOF {
+			return b, nil
+		}
+		if err != nil {
+			putBuffer(b)
+			return nil, err
+		}
+	}
+}
+
+// bufio readers and writers are pooled in the same size classes,
+// so connection holds them only while a frame is read or sent
+
+var readerPools, writerPools [maxBufferBits - minBufferBits + 1]sync.Pool
+
+// getReader returns reader with buffer of at least size bytes
+func getReader(r io.Reader, size int) *bufio.Reader {
+	c := bufferClass(size)
+	if c < 0 {
+		return bufio.NewReaderSize(r, size)
+	}
+	if br, ok := readerPools[c].Get().(*bufio.Reader); ok {
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReaderSize(r, 1<<(c+minBufferBits))
+}
+
+func putReader(br *bufio.Reader) {
+	c := bufferClass(br.Size())
+	if c < 0 || br.Size() != 1<<(c+minBufferBits) {
+		return
+	}
+	br.Reset(nil)
+	readerPools[c].Put(br)
+}
+
+// getWriter returns writer with buffer of at least size bytes
+func getWriter(w io.Writer, size int) *bufio.Writer {
+	c := bufferClass(size)
+	if c < 0 {
+		return bufio.NewWriterSize(w, size)
+	}
+	if bw, ok := writerPools[c].Get().(*bufio.Writer); ok {
+		bw.Reset(w)
+		return bw
+	}
+	return bufio.NewWriterSize(w, 1<<(c+minBufferBits))
+}
+
+func putWriter(bw *bufio.Writer) {
+	c := bufferClass(bw.Size())
+	if c < 0 || bw.Size() != 1<<(c+minBufferBits) {
+		return
+	}
+	bw.Reset(nil)
+	writerPools[c].Put(bw)
+}
+
+var messagePool = sync.Pool{
+	New: func() interface{} {
+		return new(Message)
+	},
+}
+
+func newMessage(opcode uint8, body []byte) *Message {
+	m := messagePool.Get().(*Message)
+	m.Opcode = opcode
+	m.Body = body
+	return m
+}
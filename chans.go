@@ -1,6 +1,7 @@
 package websocket
 
 import (
+	"errors"
 	"time"
 )
 
@@ -9,6 +10,13 @@ type ChannelHandler func(rc <-chan *Message, wc chan<- *Message) error
 func reader(wsc *Connection, rc chan *Message, wc chan *Message) {
 	for {
 		msg, err := wsc.Recv()
+		var ce *CloseError
+		if errors.As(err, &ce) {
+			// close is echoed by Recv, writer just stops
+			close(rc)
+			wc <- nil
+			return
+		}
 		if err != nil {
 			//wsc.LogError(err.Error())
 			wsc.LogError("1) %T %v %s", err, err, err.Error())
@@ -22,11 +30,6 @@ func reader(wsc *Connection, rc chan *Message, wc chan *Message) {
 			wc <- &Message{OPCODE_PONG, msg.Body}
 		case OPCODE_PONG:
 			// okay, ignore it
-		case OPCODE_CLOSE:
-			// echo close frame back to client
-			close(rc)
-			wc <- msg
-			return
 		default:
 			// pass to handler
 			rc <- msg
@@ -42,24 +45,30 @@ func writer(wsc *Connection, rc chan *Message, wc chan *Message) {
 			wsc.Close()
 			return
 		}
+		if msg == nil {
+			// reader got close frame
+			break
+		}
 		err := wsc.Send(msg)
 		if err != nil {
+			// peer is gone or close was already sent, nothing to wait for
 			wsc.LogError(err.Error())
-			break
+			wsc.Close()
+			return
 		}
 		if msg.Opcode == OPCODE_CLOSE {
 			break
 		}
 	}
 
-	serverClose := wsc.RcvdClose == nil
-	t := time.NewTimer(wsc.server.Config.CloseTimeout)
+	serverClose := !wsc.hasState(stateCloseRcvd)
+	t := time.NewTimer(wsc.config.CloseTimeout)
 OUT:
 	for {
 		select {
 		case msg := <-wc:
 			if serverClose {
-				if wsc.RcvdClose != nil {
+				if wsc.hasState(stateCloseRcvd) {
 					break OUT
 				}
 			} else {
@@ -68,7 +77,7 @@ OUT:
 				}
 			}
 		case <-t.C:
-			wsc.LogWarn("timeout while closing connection (serverClose=%s)", serverClose)
+			wsc.LogWarn("timeout while closing connection (serverClose=%v)", serverClose)
 			break OUT
 		}
 	}
@@ -0,0 +1,234 @@
+package websocket
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type DialConfig struct {
+	Config
+	Header    http.Header
+	TLSConfig *tls.Config
+	Dialer    *net.Dialer
+	Stats     *Stats
+}
+
+var clientStats struct {
+	once  sync.Once
+	stats *Stats
+}
+
+// stats shared by clients without DialConfig.Stats
+func defaultClientStats() *Stats {
+	clientStats.once.Do(func() {
+		clientStats.stats = newStats()
+	})
+	return clientStats.stats
+}
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+func Dial(ctx context.Context, rawurl string, config DialConfig) (*Connection, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	secure := false
+	switch u.Scheme {
+	case "ws", "http":
+	case "wss", "https":
+		secure = true
+	default:
+		return nil, fmt.Errorf("%w: unsupported url scheme %q", ErrBadHandshake, u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		if secure {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	config.Config.setDefaults()
+	if config.Stats == nil {
+		config.Stats = defaultClientStats()
+	}
+
+	dialer := config.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if secure {
+		tlsConfig := config.TLSConfig.Clone()
+		if tlsConfig == nil {
+			tlsConfig = new(tls.Config)
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	wsc := &Connection{
+		id:       nextConnectionID(),
+		config:   &config.Config,
+		stats:    config.Stats,
+		conn:     conn,
+		client:   true,
+		LogLevel: config.LogLevel,
+		logger:   config.Logger,
+	}
+	wsc.setupSocket()
+	wsc.setupSource()
+	if err := wsc.clientHandshake(ctx, u, &config); err != nil {
+		conn.Close()
+		wsc.stats.handshakeFailed()
+		return nil, err
+	}
+	// frames sent by server right after the response stay in the buffer
+	wsc.releaseReader()
+	wsc.stats.connect()
+	wsc.stats.handshake()
+	wsc.startKeepalive()
+	wsc.startRateLimit()
+	wsc.LogDebug("connection established")
+	return wsc, nil
+}
+
+func (wsc *Connection) clientHandshake(ctx context.Context, u *url.URL, config *DialConfig) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		wsc.conn.SetDeadline(deadline)
+	} else {
+		wsc.SetWriteDeadlineDuration(config.HandshakeWriteTimeout)
+		wsc.SetReadDeadlineDuration(config.HandshakeReadTimeout)
+	}
+	defer wsc.conn.SetDeadline(time.Time{})
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		exited := make(chan struct{})
+		go func() {
+			defer close(exited)
+			select {
+			case <-ctx.Done():
+				wsc.conn.SetDeadline(aLongTimeAgo)
+			case <-stop:
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-exited
+		}()
+	}
+
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for name, values := range config.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if len(config.Subprotocols) > 0 {
+		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(config.Subprotocols, ", "))
+	}
+	if config.Compression {
+		req.Header.Set("Sec-WebSocket-Extensions", deflateOffer(config.CompressionContextTakeover))
+	}
+	wsc.acquireWriter(config.HttpWriteBuffer)
+	defer wsc.releaseWriter()
+	if err := req.Write(wsc.w); err != nil {
+		return wsc.handshakeError(ctx, err)
+	}
+	if err := wsc.w.Flush(); err != nil {
+		return wsc.handshakeError(ctx, err)
+	}
+
+	// server may send frames right after the response, so ws buffer is used from the beginning
+	wsc.acquireReader(config.WsReadBuffer)
+	rsp, err := http.ReadResponse(wsc.r, req)
+	if err != nil {
+		return wsc.handshakeError(ctx, err)
+	}
+	if rsp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(io.LimitReader(rsp.Body, 1024))
+		return fmt.Errorf("%w: unexpected response status %s: %s", ErrBadHandshake, rsp.Status, body)
+	}
+	if strings.ToLower(rsp.Header.Get("Upgrade")) != "websocket" {
+		return fmt.Errorf("%w: 'Upgrade: websocket' header missed", ErrBadHandshake)
+	}
+	upgrade := false
+	for _, val := range strings.Split(rsp.Header.Get("Connection"), ",") {
+		if strings.ToLower(strings.TrimSpace(val)) == "upgrade" {
+			upgrade = true
+		}
+	}
+	if !upgrade {
+		return fmt.Errorf("%w: 'Connection: Upgrade' header missed", ErrBadHandshake)
+	}
+	if rsp.Header.Get("Sec-Websocket-Accept") != acceptKey(key) {
+		return fmt.Errorf("%w: invalid 'Sec-WebSocket-Accept' header value", ErrBadHandshake)
+	}
+	if proto := rsp.Header.Get("Sec-Websocket-Protocol"); proto != "" {
+		for _, val := range config.Subprotocols {
+			if val == proto {
+				wsc.subprotocol = proto
+			}
+		}
+		if wsc.subprotocol == "" {
+			return fmt.Errorf("%w: unexpected subprotocol %q", ErrBadHandshake, proto)
+		}
+	} else if config.SubprotocolRequired {
+		return fmt.Errorf("%w: no subprotocol selected by server", ErrBadHandshake)
+	}
+	if val := strings.Join(rsp.Header.Values("Sec-Websocket-Extensions"), ","); val != "" {
+		if !config.Compression {
+			return fmt.Errorf("%w: unexpected extensions %q", ErrBadHandshake, val)
+		}
+		p, err := acceptDeflate(val, config.CompressionContextTakeover)
+		if err != nil {
+			return err
+		}
+		wsc.Extensions = splitExtensions(val)
+		wsc.deflate = newDeflateState(p, &config.Config, true)
+	}
+	return nil
+}
+
+func (wsc *Connection) handshakeError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
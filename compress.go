@@ -0,0 +1,298 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// permessage-deflate extension (RFC 7692)
+
+const (
+	deflateExtension = "permessage-deflate"
+	deflateWindow    = 1 << 15
+	deflateMaxBits   = 15
+	deflateMinBits   = 8
+)
+
+// every compressed message ends with this sync flush marker, it is stripped before sending
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// stripped marker plus final empty stored block, so inflater reaches io.EOF
+var inflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+//////////////// Negotiation ////////////////////
+
+type extensionOffer struct {
+	name   string
+	params map[string]string
+	valid  bool
+}
+
+func parseExtensions(header string) []extensionOffer {
+	var offers []extensionOffer
+	for _, val := range strings.Split(header, ",") {
+		parts := strings.Split(val, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name == "" {
+			continue
+		}
+		offer := extensionOffer{name: name, params: make(map[string]string), valid: true}
+		for _, param := range parts[1:] {
+			key, value := param, ""
+			if i := strings.IndexByte(param, '='); i >= 0 {
+				key, value = param[:i], strings.Trim(strings.TrimSpace(param[i+1:]), "\"")
+			}
+			key = strings.ToLower(strings.TrimSpace(key))
+			if _, dup := offer.params[key]; dup || key == "" {
+				offer.valid = false
+			}
+			offer.params[key] = value
+		}
+		offers = append(offers, offer)
+	}
+	return offers
+}
+
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+	serverMaxWindowBits     int
+	clientMaxWindowBits     int
+}
+
+func parseWindowBits(value string) (int, bool) {
+	bits, err := strconv.Atoi(value)
+	if err != nil || bits < deflateMinBits || bits > deflateMaxBits {
+		return 0, false
+	}
+	return bits, true
+}
+
+func parseDeflateParams(offer extensionOffer) (p deflateParams, ok bool) {
+	if offer.name != deflateExtension || !offer.valid {
+		return p, false
+	}
+	for key, value := range offer.params {
+		switch key {
+		case "server_no_context_takeover":
+			if value != "" {
+				return p, false
+			}
+			p.serverNoContextTakeover = true
+		case "client_no_context_takeover":
+			if value != "" {
+				return p, false
+			}
+			p.clientNoContextTakeover = true
+		case "server_max_window_bits":
+			if p.serverMaxWindowBits, ok = parseWindowBits(value); !ok {
+				return p, false
+			}
+		case "client_max_window_bits":
+			// may be sent without value by client
+			if value == "" {
+				p.clientMaxWindowBits = deflateMaxBits
+			} else if p.clientMaxWindowBits, ok = parseWindowBits(value); !ok {
+				return p, false
+			}
+		default:
+			return p, false
+		}
+	}
+	return p, true
+}
+
+// negotiateDeflate selects first acceptable permessage-deflate offer of the client
+func negotiateDeflate(header string, contextTakeover bool) (p deflateParams, ok bool) {
+	for _, offer := range parseExtensions(header) {
+		p, ok = parseDeflateParams(offer)
+		if !ok {
+			continue
+		}
+		// compress/flate always uses 32k window, so smaller window can not be honored
+		if p.serverMaxWindowBits != 0 && p.serverMaxWindowBits < deflateMaxBits {
+			continue
+		}
+		if !contextTakeover {
+			p.serverNoContextTakeover = true
+			p.clientNoContextTakeover = true
+		}
+		// we inflate with 32k window anyway, no need to limit the client
+		p.clientMaxWindowBits = 0
+		return p, true
+	}
+	return p, false
+}
+
+// deflateOffer is sent by client
+func deflateOffer(contextTakeover bool) string {
+	if contextTakeover {
+		return deflateExtension + "; client_max_window_bits"
+	}
+	return deflateExtension + "; server_no_context_takeover; client_no_context_takeover; client_max_window_bits"
+}
+
+// acceptDeflate validates server's response to deflateOffer
+func acceptDeflate(header string, contextTakeover bool) (p deflateParams, err error) {
+	offers := parseExtensions(header)
+	if len(offers) != 1 {
+		return p, fmt.Errorf("%w: unexpected extensions %q", ErrBadHandshake, header)
+	}
+	p, ok := parseDeflateParams(offers[0])
+	// compress/flate can't limit window of compressor
+	if !ok || (p.clientMaxWindowBits != 0 && p.clientMaxWindowBits < deflateMaxBits) {
+		return p, fmt.Errorf("%w: unacceptable extension %q", ErrBadHandshake, header)
+	}
+	if !contextTakeover && !p.serverNoContextTakeover {
+		return p, fmt.Errorf("%w: server_no_context_takeover expected", ErrBadHandshake)
+	}
+	return p, nil
+}
+
+func (p deflateParams) String() string {
+	s := deflateExtension
+	if p.serverNoContextTakeover {
+		s += "; server_no_context_takeover"
+	}
+	if p.clientNoContextTakeover {
+		s += "; client_no_context_takeover"
+	}
+	if p.serverMaxWindowBits != 0 {
+		s += "; server_max_window_bits=" + strconv.Itoa(p.serverMaxWindowBits)
+	}
+	if p.clientMaxWindowBits != 0 {
+		s += "; client_max_window_bits=" + strconv.Itoa(p.clientMaxWindowBits)
+	}
+	return s
+}
+
+//////////////// Compression state ////////////////////
+
+var flateWriterPools [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+var flateReaderPool sync.Pool
+
+type deflateState struct {
+	level                int
+	threshold            int
+	outNoContextTakeover bool
+	inNoContextTakeover  bool
+	fw                   *flate.Writer // kept between messages with context takeover
+	fbuf                 bytes.Buffer
+	dict                 []byte // last inflated window with context takeover
+}
+
+func newDeflateState(p deflateParams, config *Config, client bool) *deflateState {
+	ds := &deflateState{
+		level:                config.CompressionLevel,
+		threshold:            config.CompressionThreshold,
+		outNoContextTakeover: p.serverNoContextTakeover,
+		inNoContextTakeover:  p.clientNoContextTakeover,
+	}
+	if client {
+		ds.outNoContextTakeover, ds.inNoContextTakeover = ds.inNoContextTakeover, ds.outNoContextTakeover
+		// client is free to reset its own context
+		ds.outNoContextTakeover = ds.outNoContextTakeover || !config.CompressionContextTakeover
+	}
+	return ds
+}
+
+func (ds *deflateState) getWriter() (*flate.Writer, *bytes.Buffer) {
+	if !ds.outNoContextTakeover {
+		if ds.fw == nil {
+			ds.fw, _ = flate.NewWriter(&ds.fbuf, ds.level)
+		}
+		return ds.fw, &ds.fbuf
+	}
+	buf := new(bytes.Buffer)
+	pool := &flateWriterPools[ds.level-flate.HuffmanOnly]
+	if fw, ok := pool.Get().(*flate.Writer); ok {
+		fw.Reset(buf)
+		return fw, buf
+	}
+	fw, _ := flate.NewWriter(buf, ds.level)
+	return fw, buf
+}
+
+func (ds *deflateState) putWriter(fw *flate.Writer, buf *bytes.Buffer) {
+	if !ds.outNoContextTakeover {
+		ds.fbuf.Reset()
+		return
+	}
+	fw.Reset(io.Discard)
+	flateWriterPools[ds.level-flate.HuffmanOnly].Put(fw)
+}
+
+func (ds *deflateState) compress(b []byte) ([]byte, error) {
+	fw, buf := ds.getWriter()
+	defer ds.putWriter(fw, buf)
+	if _, err := fw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+	res := bytes.TrimSuffix(buf.Bytes(), deflateTail)
+	return append(getBuffer(len(res))[:0], res...), nil
+}
+
+type inflateReader struct {
+	ds *deflateState
+	fr io.ReadCloser
+}
+
+func (ds *deflateState) newReader(src io.Reader) io.ReadCloser {
+	src = io.MultiReader(src, bytes.NewReader(inflateTail))
+	var dict []byte
+	if !ds.inNoContextTakeover {
+		dict = ds.dict
+	}
+	fr, ok := flateReaderPool.Get().(io.ReadCloser)
+	if ok {
+		fr.(flate.Resetter).Reset(src, dict)
+	} else {
+		fr = flate.NewReaderDict(src, dict)
+	}
+	return &inflateReader{ds: ds, fr: fr}
+}
+
+func (ir *inflateReader) Read(b []byte) (int, error) {
+	n, err := ir.fr.Read(b)
+	if !ir.ds.inNoContextTakeover {
+		ir.ds.appendDict(b[:n])
+	}
+	switch err.(type) {
+	case flate.CorruptInputError, flate.InternalError:
+		err = ErrBadCompression
+	}
+	if err == io.ErrUnexpectedEOF {
+		err = ErrBadCompression
+	}
+	return n, err
+}
+
+func (ir *inflateReader) Close() error {
+	if ir.fr != nil {
+		flateReaderPool.Put(ir.fr)
+		ir.fr = nil
+	}
+	return nil
+}
+
+func (ds *deflateState) appendDict(b []byte) {
+	ds.dict = append(ds.dict, b...)
+	if extra := len(ds.dict) - deflateWindow; extra > 0 {
+		copy(ds.dict, ds.dict[extra:])
+		ds.dict = ds.dict[:deflateWindow]
+	}
+}
+
+func (ds *deflateState) decompress(b []byte, limit int) ([]byte, error) {
+	r := ds.newReader(bytes.NewReader(b))
+	defer r.Close()
+	return readBuffer(r, 2*len(b), limit)
+}
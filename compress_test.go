@@ -0,0 +1,137 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestNegotiateDeflate(t *testing.T) {
+	tests := []struct {
+		header          string
+		contextTakeover bool
+		ok              bool
+		response        string
+	}{
+		{"permessage-deflate", false, true, "permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+		{"permessage-deflate", true, true, "permessage-deflate"},
+		{"permessage-deflate; client_max_window_bits", true, true, "permessage-deflate"},
+		{"permessage-deflate; client_max_window_bits=10", true, true, "permessage-deflate"},
+		{`permessage-deflate; client_max_window_bits="10"`, true, true, "permessage-deflate"},
+		{"permessage-deflate; server_max_window_bits=15", true, true, "permessage-deflate; server_max_window_bits=15"},
+		{"permessage-deflate; server_no_context_takeover", true, true, "permessage-deflate; server_no_context_takeover"},
+		{"Permessage-Deflate; Client_No_Context_Takeover", true, true, "permessage-deflate; client_no_context_takeover"},
+		{"x-webkit-deflate-frame, permessage-deflate", true, true, "permessage-deflate"},
+		// smaller window can't be honored, the next offer is taken
+		{"permessage-deflate; server_max_window_bits=10, permessage-deflate", true, true, "permessage-deflate"},
+		{"permessage-deflate; server_max_window_bits=10", true, false, ""},
+		{"permessage-deflate; server_max_window_bits", true, false, ""},
+		{"permessage-deflate; client_max_window_bits=7", true, false, ""},
+		{"permessage-deflate; client_max_window_bits=16", true, false, ""},
+		{"permessage-deflate; server_no_context_takeover=1", true, false, ""},
+		{"permessage-deflate; server_no_context_takeover; server_no_context_takeover", true, false, ""},
+		{"permessage-deflate; mux", true, false, ""},
+		{"permessage-deflate; =1", true, false, ""},
+		{"x-webkit-deflate-frame", true, false, ""},
+		{"", true, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%v", tt.header, tt.contextTakeover), func(t *testing.T) {
+			p, ok := negotiateDeflate(tt.header, tt.contextTakeover)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, %v expected", ok, tt.ok)
+			}
+			if ok && p.String() != tt.response {
+				t.Errorf("response %q, %q expected", p.String(), tt.response)
+			}
+		})
+	}
+}
+
+func TestAcceptDeflate(t *testing.T) {
+	tests := []struct {
+		header          string
+		contextTakeover bool
+		ok              bool
+	}{
+		{"permessage-deflate; server_no_context_takeover; client_no_context_takeover", false, true},
+		{"permessage-deflate; server_no_context_takeover", false, true},
+		{"permessage-deflate", false, false},
+		{"permessage-deflate", true, true},
+		{"permessage-deflate; server_max_window_bits=10", true, true},
+		{"permessage-deflate; client_max_window_bits=15", true, true},
+		{"permessage-deflate; client_max_window_bits=10", true, false},
+		{"permessage-deflate; unknown", true, false},
+		{"permessage-deflate, permessage-deflate", true, false},
+		{"x-webkit-deflate-frame", true, false},
+		{"", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%v", tt.header, tt.contextTakeover), func(t *testing.T) {
+			_, err := acceptDeflate(tt.header, tt.contextTakeover)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err = %v, ok %v expected", err, tt.ok)
+			}
+			if err != nil && !errors.Is(err, ErrBadHandshake) {
+				t.Errorf("%v is not ErrBadHandshake", err)
+			}
+		})
+	}
+}
+
+func TestDeflateRoundTrip(t *testing.T) {
+	for _, contextTakeover := range []bool{false, true} {
+		t.Run(fmt.Sprintf("context takeover %v", contextTakeover), func(t *testing.T) {
+			config := Config{CompressionContextTakeover: contextTakeover}
+			config.setDefaults()
+			p, ok := negotiateDeflate(deflateOffer(contextTakeover), contextTakeover)
+			if !ok {
+				t.Fatal("offer of client is not accepted")
+			}
+			if _, err := acceptDeflate(p.String(), contextTakeover); err != nil {
+				t.Fatal(err)
+			}
+			srv := newDeflateState(p, &config, false)
+			cli := newDeflateState(p, &config, true)
+			// the same message repeated, so that context takeover makes it shorter
+			msg := bytes.Repeat([]byte("round trip "), 200)
+			var sizes []int
+			for i := 0; i < 3; i++ {
+				for _, pair := range [][2]*deflateState{{srv, cli}, {cli, srv}} {
+					b, err := pair[0].compress(msg)
+					if err != nil {
+						t.Fatal(err)
+					}
+					sizes = append(sizes, len(b))
+					res, err := pair[1].decompress(b, len(msg))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(res, msg) {
+						t.Fatalf("message %d is corrupted", i)
+					}
+				}
+			}
+			if shorter := sizes[len(sizes)-1] < sizes[0]; shorter != contextTakeover {
+				t.Errorf("compressed sizes %v", sizes)
+			}
+		})
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	config := Config{}
+	config.setDefaults()
+	ds := newDeflateState(deflateParams{serverNoContextTakeover: true, clientNoContextTakeover: true}, &config, false)
+	b, err := ds.compress(make([]byte, 64*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.decompress(b, 1024); err != ErrMessageTooLarge {
+		t.Errorf("err = %v, %v expected", err, ErrMessageTooLarge)
+	}
+	if _, err := ds.decompress([]byte{0xff, 0xff, 0xff}, 1024); err != ErrBadCompression {
+		t.Errorf("err = %v, %v expected", err, ErrBadCompression)
+	}
+}
@@ -2,20 +2,23 @@ package websocket
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
 	"crypto/sha1"
-	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
-	"reflect"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
-	"unsafe"
+	"unicode/utf8"
 )
 
 type HandlerFunc func(*Connection) error
@@ -23,16 +26,74 @@ type HandlerFunc func(*Connection) error
 type HandshakeFunc func(*Connection, *http.Request, http.ResponseWriter) HandlerFunc
 
 type Connection struct {
-	server     *Server
-	conn       net.Conn
-	r          *bufio.Reader
-	w          *bufio.Writer
-	Extensions []string
-	LogLevel   uint8
-	mm         *MultiframeMessage
-	RcvdClose  *Message
-	SentClose  *Message
-	closed     bool
+	rdeadline   int64 // unix nanos of the last read deadline, accessed atomically
+	wdeadline   int64 // unix nanos of the last write deadline, accessed atomically
+	id          uint64
+	server      *Server
+	config      *Config
+	stats       *Stats
+	shard       *statsShard // counters of frames and socket IO
+	conn        net.Conn
+	src         connReader
+	dst         io.Writer
+	r           *bufio.Reader // taken from the pool while a frame is read
+	w           *bufio.Writer // taken from the pool while a frame is sent
+	client      bool
+	Extensions  []string
+	subprotocol string
+	LogLevel    uint8
+	logger      Logger
+	mm          *MultiframeMessage
+	fragmented  MultiframeMessage // storage of mm
+	utf8        utf8Validator
+	deflate     *deflateState
+	ka          *keepalive
+	limiter     *rateLimiter   // nil if frames are not limited
+	inFrame     bool           // frame is partially read
+	reader      *MessageReader // current NextReader message
+	maxMsgLen   int
+	RcvdClose   *Message
+	closeErr    *CloseError // returned by reads after close is received
+	SentClose   *Message
+	handler     HandlerFunc     // run by event loop worker when parked connection is woken
+	runner      bool            // handler is run by the server, so it may be parked
+	resumed     bool            // handler is run by event loop worker
+	polled      bool            // registered in event loop
+	raw         syscall.RawConn // socket to poll
+	parked      uint32          // 1 while connection waits in event loop, accessed atomically
+	state       uint32          // stateXXX bits, accessed atomically
+	rmu         sync.Mutex      // held while reading
+	wmu         sync.Mutex      // held while writing a frame
+	msgMu       sync.Mutex      // held while writing a data message, taken before wmu
+	hookMu      sync.Mutex
+	closeHooks  []func() // called once by Close
+}
+
+// connection state bits, each one is set once
+const (
+	stateCloseSent uint32 = 1 << iota
+	stateCloseRcvd
+	stateClosed
+	stateReadBroken  // read was interrupted in the middle of frame
+	stateWriteBroken // write was interrupted in the middle of frame
+)
+
+// setState sets state bit, returns false if it was already set
+func (wsc *Connection) setState(bit uint32) bool {
+	for {
+		old := atomic.LoadUint32(&wsc.state)
+		if old&bit != 0 {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(&wsc.state, old, old|bit) {
+			return true
+		}
+	}
+}
+
+// hasState reports whether any of bits is set
+func (wsc *Connection) hasState(bits uint32) bool {
+	return atomic.LoadUint32(&wsc.state)&bits != 0
 }
 
 func acceptKey(key string) string {
@@ -45,113 +106,271 @@ func acceptKey(key string) string {
 
 func newConnection(server *Server, conn net.Conn) *Connection {
 	wsc := &Connection{
+		id:       nextConnectionID(),
 		server:   server,
+		config:   server.Config,
+		stats:    server.Stats,
 		conn:     conn,
 		LogLevel: server.Config.LogLevel,
+		logger:   server.Config.Logger,
 	}
-	var tconn *net.TCPConn
-	switch conn := conn.(type) {
-	case *net.TCPConn:
-		tconn = conn
-	case *tls.Conn:
-		v := reflect.ValueOf(conn).Elem().FieldByName("conn")
-		tconn = (*net.TCPConn)(unsafe.Pointer(v.Elem().Pointer()))
-	default:
-		panic("unexpected type of connection: neither TCP nor TLS")
-	}
-	tconn.SetReadBuffer(server.Config.SockReadBuffer)
-	tconn.SetWriteBuffer(server.Config.SockWriteBuffer)
-	if server.Config.TCPKeepAlive > 0 {
-		tconn.SetKeepAlive(true)
-		tconn.SetKeepAlivePeriod(server.Config.TCPKeepAlive)
-	}
-	wsc.setupBuffio(server.Config.HttpReadBuffer, server.Config.HttpWriteBuffer)
+	wsc.setupSocket()
+	wsc.setupSource()
 	return wsc
 }
 
-func (wsc *Connection) setupBuffio(rs, ws int) {
-	var r io.Reader
-	var w io.Writer
-	if wsc.server.Config.IOStatistics {
-		r = &ReaderWithStats{r: wsc.conn, stats: wsc.server.Stats}
-		w = &WriterWithStats{w: wsc.conn, stats: wsc.server.Stats}
+// implemented by *tls.Conn and other wrappers
+type netConnWrapper interface {
+	NetConn() net.Conn
+}
+
+type socketBuffers interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+type socketKeepAlive interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// socketConn unwraps conn down to the socket
+func socketConn(conn net.Conn) net.Conn {
+	for i := 0; i < 8; i++ {
+		w, ok := conn.(netConnWrapper)
+		if !ok {
+			break
+		}
+		inner := w.NetConn()
+		if inner == nil || inner == conn {
+			break
+		}
+		conn = inner
+	}
+	return conn
+}
+
+// setupSocket tunes socket if it is available, any other net.Conn is left as is
+func (wsc *Connection) setupSocket() {
+	conn := socketConn(wsc.conn)
+	if sb, ok := conn.(socketBuffers); ok {
+		sb.SetReadBuffer(wsc.config.SockReadBuffer)
+		sb.SetWriteBuffer(wsc.config.SockWriteBuffer)
+	}
+	if ka, ok := conn.(socketKeepAlive); ok && wsc.config.TCPKeepAlive > 0 {
+		ka.SetKeepAlive(true)
+		ka.SetKeepAlivePeriod(wsc.config.TCPKeepAlive)
+	}
+}
+
+// setupSource prepares socket reader and writer, buffers are taken from the pool when needed
+func (wsc *Connection) setupSource() {
+	wsc.shard = wsc.stats.shard()
+	if wsc.config.IOStatistics {
+		wsc.src.r = &ReaderWithStats{r: wsc.conn, shard: wsc.shard}
+		wsc.dst = &WriterWithStats{w: wsc.conn, shard: wsc.shard}
 	} else {
-		r = wsc.conn
-		w = wsc.conn
+		wsc.src.r = wsc.conn
+		wsc.dst = wsc.conn
 	}
-	wsc.r = bufio.NewReaderSize(r, rs)
-	wsc.w = bufio.NewWriterSize(w, ws)
+}
+
+// connReader returns the byte read while waiting for a frame before reading the socket
+type connReader struct {
+	r     io.Reader
+	first [1]byte
+	n     int
+}
+
+func (cr *connReader) Read(b []byte) (int, error) {
+	if cr.n > 0 && len(b) > 0 {
+		b[0] = cr.first[0]
+		cr.n = 0
+		return 1, nil
+	}
+	return cr.r.Read(b)
+}
+
+// wait blocks until the first byte arrives
+func (cr *connReader) wait() error {
+	for cr.n == 0 {
+		n, err := cr.r.Read(cr.first[:])
+		cr.n = n
+		if n == 0 && err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitFrame waits for the next frame without read buffer, buffer is taken
+// when the frame starts arriving. Interrupted wait leaves connection usable.
+func (wsc *Connection) waitFrame() error {
+	if wsc.r != nil && wsc.r.Buffered() > 0 {
+		return nil
+	}
+	wsc.releaseReader()
+	if err := wsc.src.wait(); err != nil {
+		return err
+	}
+	wsc.acquireReader(wsc.config.WsReadBuffer)
+	return nil
+}
+
+func (wsc *Connection) acquireReader(size int) {
+	if wsc.r == nil {
+		wsc.r = getReader(&wsc.src, size)
+	}
+}
+
+// releaseReader returns empty read buffer to the pool
+func (wsc *Connection) releaseReader() {
+	if wsc.r != nil && wsc.r.Buffered() == 0 {
+		putReader(wsc.r)
+		wsc.r = nil
+	}
+}
+
+func (wsc *Connection) acquireWriter(size int) {
+	if wsc.w == nil {
+		wsc.w = getWriter(wsc.dst, size)
+	}
+}
+
+// releaseWriter returns flushed write buffer to the pool
+func (wsc *Connection) releaseWriter() {
+	if wsc.w != nil && wsc.w.Buffered() == 0 {
+		putWriter(wsc.w)
+		wsc.w = nil
+	}
+}
+
+// flushWriter sends the tail of fragment left in write buffer by MessageWriter,
+// so that frames written past the buffer do not get into the middle of it
+func (wsc *Connection) flushWriter() error {
+	if wsc.w == nil {
+		return nil
+	}
+	if err := wsc.w.Flush(); err != nil {
+		return err
+	}
+	wsc.releaseWriter()
+	return nil
+}
+
+func (wsc *Connection) writeResponse(rspw *httpResponseWriter) error {
+	wsc.acquireWriter(wsc.config.HttpWriteBuffer)
+	defer wsc.releaseWriter()
+	wsc.SetWriteDeadlineDuration(wsc.config.HandshakeWriteTimeout)
+	defer wsc.SetWriteDeadlineDuration(0)
+	if err := rspw.WriteResponse(wsc.w); err != nil {
+		return err
+	}
+	return wsc.w.Flush()
 }
 
 func (wsc *Connection) serve() {
+	// once handed over to event loop, connection is not touched here
+	detached := false
 	defer func() {
-		if err := recover(); err != nil {
-			wsc.LogError("panic: %s\n%s", err, debug.Stack())
-		}
-		if !wsc.closed {
-			wsc.Close()
+		if !detached {
+			wsc.finish(recover())
 		}
-		wsc.LogDebug("connection closed")
-		wsc.server.Stats.add(eventClose{})
 	}()
 	wsc.LogDebug("connection established")
-	wsc.server.Stats.add(eventConnect{})
+	wsc.stats.connect()
 
-	wsc.SetReadDeadlineDuration(wsc.server.Config.HandshakeReadTimeout)
+	wsc.SetReadDeadlineDuration(wsc.config.HandshakeReadTimeout)
+	wsc.acquireReader(wsc.config.HttpReadBuffer)
 	req, err := http.ReadRequest(wsc.r)
 	wsc.SetReadDeadlineDuration(0)
 
-	rspw := newHtttpResponseWriter()
-
 	if err != nil {
 		wsc.LogError("http parse %s", err)
+		rspw := newHtttpResponseWriter()
 		rspw.Header().Set("Content-Type", "text/plain")
 		rspw.Header().Set("Connection", "close")
 		rspw.WriteHeader(http.StatusBadRequest)
-		wsc.SetWriteDeadlineDuration(wsc.server.Config.HandshakeWriteTimeout)
-		rspw.WriteTo(wsc.w)
-		wsc.w.Flush()
-		wsc.SetWriteDeadlineDuration(0)
+		wsc.writeResponse(rspw)
 		wsc.Close()
-		wsc.server.Stats.add(eventHandshakeFailed{})
+		wsc.stats.handshakeFailed()
 		return
 	}
 	req.RemoteAddr = wsc.conn.RemoteAddr().String()
+	handler, _ := wsc.handshake(req)
+	if handler == nil {
+		return
+	}
+	detached = wsc.run(handler)
+}
+
+// finish is deferred by the goroutine running the handler, p is recovered panic
+func (wsc *Connection) finish(p interface{}) {
+	if p != nil {
+		wsc.LogError("panic: %s\n%s", p, debug.Stack())
+	}
+	if !wsc.hasState(stateClosed) {
+		wsc.Close()
+	}
+	if wsc.polled {
+		wsc.server.loop.remove(wsc)
+	}
+	// Close forgets connection too, but it may be closed by keepalive before handshake adds it
+	if wsc.server != nil {
+		wsc.server.trackConn(wsc, false)
+	}
+	wsc.LogDebug("connection closed")
+}
+
+// run returns true if handler parked connection in event loop
+func (wsc *Connection) run(handler HandlerFunc) bool {
+	wsc.runner = true
+	err := handler(wsc)
+	if err == errParked {
+		return true
+	}
+	var ce *CloseError
+	if err != nil && err != io.EOF && !errors.As(err, &ce) {
+		wsc.LogError("err: %T %s", err, err.Error())
+	}
+	return false
+}
+
+// handshake validates request, sends response and switches connection to websocket mode
+func (wsc *Connection) handshake(req *http.Request) (HandlerFunc, error) {
+	rspw := newHtttpResponseWriter()
 	handler := wsc.httpHandshake(req, rspw)
 	if handler == nil {
+		if rspw.rsp.StatusCode == 0 {
+			rspw.WriteHeader(http.StatusBadRequest)
+		}
+		err := fmt.Errorf("%w: %d %s", ErrBadHandshake, rspw.rsp.StatusCode, rspw.body.String())
 		wsc.LogError("handshake failed %d: %s", rspw.rsp.StatusCode, rspw.body.String())
 		rspw.Header().Set("Content-Type", "text/plain")
 		rspw.Header().Set("Connection", "close")
-		wsc.SetWriteDeadlineDuration(wsc.server.Config.HandshakeWriteTimeout)
-		rspw.WriteTo(wsc.w)
-		wsc.w.Flush()
-		wsc.SetWriteDeadlineDuration(0)
+		wsc.writeResponse(rspw)
 		wsc.Close()
-		wsc.server.Stats.add(eventHandshakeFailed{})
-		return
+		wsc.stats.handshakeFailed()
+		return nil, err
 	} else {
-		wsc.SetWriteDeadlineDuration(wsc.server.Config.HandshakeWriteTimeout)
-		rspw.WriteTo(wsc.w)
-		wsc.w.Flush()
-		wsc.SetWriteDeadlineDuration(0)
-	}
-	wsc.server.Stats.add(eventHandshake{})
-	// let gc rip them
-	req = nil
-	rspw = nil
-
-	// change bufferization
-	if wsc.r.Buffered() > 0 {
+		wsc.writeResponse(rspw)
+	}
+	wsc.stats.handshake()
+
+	// http buffer is not needed anymore, ws ones are taken from the pool for every frame
+	if wsc.r != nil && wsc.r.Buffered() > 0 {
 		panic("unread data in buffer after http handshake")
 	}
-	wsc.w.Flush()
-	wsc.setupBuffio(wsc.server.Config.WsReadBuffer, wsc.server.Config.WsWriteBuffer)
+	wsc.releaseReader()
 
-	// run ws
-	err = handler(wsc)
-	if err != nil && err != io.EOF {
-		wsc.LogError("err: %T %s", err, err.Error())
+	wsc.startKeepalive()
+	wsc.startRateLimit()
+	// server shutdown may have started during handshake
+	if !wsc.server.trackConn(wsc, true) {
+		wsc.CloseGraceful(STATUS_GOAWAY, "server shutdown")
+		return nil, ErrServerClosed
 	}
+	return handler, nil
 }
 
 func (wsc *Connection) httpHandshake(req *http.Request, rspw http.ResponseWriter) HandlerFunc {
@@ -192,103 +411,352 @@ func (wsc *Connection) httpHandshake(req *http.Request, rspw http.ResponseWriter
 		rspw.Write([]byte("'Sec-WebSocket-Version' header missed"))
 		return nil
 	}
-	if val := req.Header.Get("Sec-Websocket-Extensions"); val != "" {
-		for _, val := range strings.Split(val, ",") {
-			for _, ext := range strings.Split(val, ";") {
-				if ext := strings.TrimSpace(ext); ext != "" {
-					wsc.Extensions = append(wsc.Extensions, ext)
-				}
-			}
-		}
-		if len(wsc.Extensions) > 0 {
-			// TODO: запилить экстеншенов что ли
+	if !wsc.checkOrigin(req) {
+		wsc.LogWarn("origin %q not allowed", req.Header.Get("Origin"))
+		rspw.WriteHeader(http.StatusForbidden)
+		rspw.Write([]byte("Origin not allowed"))
+		return nil
+	}
+	var deflate deflateParams
+	var compress bool
+	if val := strings.Join(req.Header.Values("Sec-Websocket-Extensions"), ","); val != "" {
+		wsc.Extensions = splitExtensions(val)
+		if wsc.config.Compression {
+			deflate, compress = negotiateDeflate(val, wsc.config.CompressionContextTakeover)
 		}
 	}
-	handler := wsc.server.Config.Handshake(wsc, req, rspw)
+	offered := splitTokens(strings.Join(req.Header.Values("Sec-Websocket-Protocol"), ","))
+	wsc.subprotocol = wsc.selectSubprotocol(offered)
+	if wsc.subprotocol == "" && wsc.config.SubprotocolRequired {
+		rspw.WriteHeader(http.StatusBadRequest)
+		rspw.Write([]byte("No acceptable 'Sec-WebSocket-Protocol' (expected one of: " + strings.Join(wsc.config.Subprotocols, ", ") + ")"))
+		return nil
+	}
+	handler := wsc.config.Handshake(wsc, req, rspw)
 	if handler != nil {
 		rspw.Header().Set("Upgrade", "websocket")
 		rspw.Header().Set("Connection", "Upgrade")
 		rspw.Header().Set("Sec-WebSocket-Accept", acceptKey(req.Header.Get("Sec-Websocket-Key")))
+		if wsc.subprotocol != "" {
+			rspw.Header().Set("Sec-WebSocket-Protocol", wsc.subprotocol)
+		}
+		if compress {
+			rspw.Header().Set("Sec-WebSocket-Extensions", deflate.String())
+			wsc.deflate = newDeflateState(deflate, wsc.config, false)
+		}
 		rspw.WriteHeader(http.StatusSwitchingProtocols)
 	}
 	return handler
 }
 
+func splitTokens(header string) (tokens []string) {
+	for _, val := range strings.Split(header, ",") {
+		if val := strings.TrimSpace(val); val != "" {
+			tokens = append(tokens, val)
+		}
+	}
+	return
+}
+
+func (wsc *Connection) selectSubprotocol(offered []string) string {
+	if len(offered) == 0 {
+		return ""
+	}
+	if wsc.config.SelectSubprotocol != nil {
+		proto := wsc.config.SelectSubprotocol(wsc, offered)
+		for _, val := range offered {
+			if val == proto {
+				return proto
+			}
+		}
+		if proto != "" {
+			wsc.LogWarn("selected subprotocol %q was not offered by client", proto)
+		}
+		return ""
+	}
+	// server order of preference
+	for _, proto := range wsc.config.Subprotocols {
+		for _, val := range offered {
+			if val == proto {
+				return proto
+			}
+		}
+	}
+	return ""
+}
+
+// Subprotocol returns negotiated Sec-WebSocket-Protocol
+func (wsc *Connection) Subprotocol() string {
+	return wsc.subprotocol
+}
+
+// ID returns connection id, unique within the process, see Server.Connection
+func (wsc *Connection) ID() uint64 {
+	return wsc.id
+}
+
+func splitExtensions(header string) (extensions []string) {
+	for _, val := range strings.Split(header, ",") {
+		for _, ext := range strings.Split(val, ";") {
+			if ext := strings.TrimSpace(ext); ext != "" {
+				extensions = append(extensions, ext)
+			}
+		}
+	}
+	return
+}
+
 //////////////// Read - Write interface ////////////////////
 
+// returned by nextFrame when control frame is queued in MessageReader.ctrl
+var errControlFrame = errors.New("control frame")
+
 type MessageReader struct {
-	wsc    *Connection
-	frame  *Frame
-	opened bool
-	err    error
+	wsc     *Connection
+	frame   *Frame
+	opened  bool
+	err     error
+	inflate io.ReadCloser
+	ctrl    []*Message
+	opcode  uint8
+	utf8    utf8Validator
+	auto    bool // control frames are handled internally
+	limit   int
+	size    int // payload length of received frames
+	n       int // bytes returned
 }
 
+// NewReader returns reader of the next message, pings and pongs are returned as *Message errors,
+// close frame is echoed and returned as *CloseError
 func (wsc *Connection) NewReader() *MessageReader {
 	return &MessageReader{wsc: wsc}
 }
 
+// NextReader waits for the next data message and returns its opcode and reader.
+// Pings are answered and close frame is echoed internally, received close results in *CloseError.
+// Unread part of the previous message is discarded. Read errors are permanent.
+func (wsc *Connection) NextReader() (uint8, io.Reader, error) {
+	wsc.rmu.Lock()
+	defer wsc.rmu.Unlock()
+	if prev := wsc.reader; prev != nil {
+		wsc.reader = nil
+		var buf [512]byte
+		for prev.err == nil {
+			prev.read(buf[:])
+		}
+		if prev.err != io.EOF {
+			return 0, nil, prev.err
+		}
+	}
+	if wsc.hasState(stateReadBroken) {
+		return 0, nil, ErrConnectionBroken
+	}
+	if wsc.hasState(stateCloseRcvd | stateClosed) {
+		return 0, nil, wsc.eof()
+	}
+	mr := &MessageReader{wsc: wsc, auto: true, limit: wsc.msgLimit()}
+	if err := mr.nextFrame(); err != nil {
+		_, err = mr.result(0, err)
+		return 0, nil, err
+	}
+	wsc.reader = mr
+	return mr.opcode, mr, nil
+}
+
 func (mr *MessageReader) Read(b []byte) (int, error) {
+	mr.wsc.rmu.Lock()
+	defer mr.wsc.rmu.Unlock()
+	return mr.read(b)
+}
+
+func (mr *MessageReader) read(b []byte) (int, error) {
+	if len(mr.ctrl) > 0 {
+		return mr.result(0, errControlFrame)
+	}
 	if mr.err != nil {
 		return 0, mr.err
 	}
-	f := mr.frame
-	if f == nil {
-		f = newFrame(mr.wsc)
+	if !mr.opened {
+		if err := mr.nextFrame(); err != nil {
+			return mr.result(0, err)
+		}
+	}
+	var n int
+	var err error
+	if mr.inflate != nil {
+		n, err = mr.inflate.Read(b)
+	} else {
+		n, err = mr.readPayload(b)
+	}
+	mr.n += n
+	if mr.limit > 0 && mr.n > mr.limit {
+		return mr.result(0, ErrMessageTooLarge)
+	}
+	if mr.opcode == OPCODE_TEXT && !mr.wsc.config.SkipUTF8Validation && (err == nil || err == io.EOF) {
+		if !mr.utf8.feed(b[:n]) || (err == io.EOF && !mr.utf8.finish()) {
+			return mr.result(0, ErrInvalidUTF8)
+		}
+	}
+	return mr.result(n, err)
+}
+
+func (mr *MessageReader) result(n int, err error) (int, error) {
+	if err == errControlFrame || (err != nil && len(mr.ctrl) > 0) {
+		// control frame - return out of order as errors
+		m := mr.ctrl[0]
+		mr.ctrl = mr.ctrl[1:]
+		if m.Opcode == OPCODE_CLOSE {
+			err := mr.wsc.closeErr
+			mr.fail(err)
+			return n, err
+		}
+		return n, m
+	}
+	if err != nil {
+		err = mr.wsc.ka.ioError(err)
+		mr.fail(err)
+	}
+	return n, err
+}
+
+func (mr *MessageReader) fail(err error) {
+	mr.err = err
+	if mr.inflate != nil {
+		mr.inflate.Close()
+		mr.inflate = nil
+	}
+	mr.wsc.releaseReader()
+	if mr.auto && err != io.EOF && !mr.wsc.hasState(stateCloseRcvd) {
+		mr.wsc.setState(stateReadBroken)
+	}
+}
+
+// control handles control frame received by NextReader
+func (mr *MessageReader) control(m *Message) error {
+	switch m.Opcode {
+	case OPCODE_PING:
+		if err := mr.wsc.Send(&Message{OPCODE_PONG, m.Body}); err != nil && err != ErrConnectionClosed {
+			return err
+		}
+	case OPCODE_CLOSE:
+		return mr.wsc.closeReceived(m)
+	}
+	return nil
+}
+
+// nextFrame reads headers until the next data frame of the message,
+// control frames are queued
+func (mr *MessageReader) nextFrame() error {
+	for {
+		if err := mr.wsc.waitFrame(); err != nil {
+			return err
+		}
+		f := newReadFrame(mr.wsc)
 		if err := f.readHeader(); err != nil {
-			mr.err = err
-			return 0, mr.err
+			return err
+		}
+		if mr.wsc.LogLevel >= LOG_DEBUG {
+			mr.wsc.LogDebug("frame header received: %s", f.String())
 		}
-		mr.wsc.LogDebug("frame header received: %s", f)
 		switch f.Opcode {
 		case OPCODE_PING, OPCODE_PONG, OPCODE_CLOSE:
 			b, err := f.recv()
 			if err != nil {
-				mr.err = err
-				return 0, mr.err
+				return err
+			}
+			if f.Opcode == OPCODE_CLOSE {
+				if err := validateCloseBody(b, !mr.wsc.config.SkipUTF8Validation); err != nil {
+					return err
+				}
 			}
-			// control frame - return out of order as errors
 			m := &Message{f.Opcode, b}
+			if mr.auto {
+				if err := mr.control(m); err != nil {
+					return err
+				}
+				putBuffer(b)
+				continue
+			}
+			mr.ctrl = append(mr.ctrl, m)
 			if f.Opcode == OPCODE_CLOSE {
-				mr.wsc.RcvdClose = m
-				mr.err = io.EOF
+				mr.wsc.closeReceived(m)
+				return errControlFrame
 			}
-			return 0, m
+			// inflater can't be interrupted, deliver after decompressed data
+			if mr.inflate != nil {
+				continue
+			}
+			return errControlFrame
 		case OPCODE_TEXT, OPCODE_BINARY:
 			if mr.opened {
-				mr.err = ErrUnexpectedFrame
-				return 0, mr.err
-			} else {
-				mr.opened = true
+				return ErrUnexpectedFrame
+			}
+			mr.opened = true
+			mr.opcode = f.Opcode
+			if f.Rsv1 {
+				mr.inflate = mr.wsc.deflate.newReader(messageReaderRaw{mr})
 			}
 		case OPCODE_CONTINUATION:
 			if !mr.opened {
-				mr.err = ErrUnexpectedContinuation
-				return 0, mr.err
+				return ErrUnexpectedContinuation
 			}
 		default:
-			mr.err = ErrUnknownOpcode
-			return 0, mr.err
+			return ErrUnknownOpcode
 		}
-		mr.frame = f
+		// compressed payload is limited after inflate
+		mr.size += f.Len
+		if mr.limit > 0 && mr.inflate == nil && mr.size > mr.limit {
+			return ErrMessageTooLarge
+		}
+		mr.frame = &f
+		return nil
 	}
-	n, err := f.read(b)
-	mr.wsc.LogDebug("frame body read: %d", n)
-	if err == EndOfFrame {
-		if f.Fin {
-			err = io.EOF
-			mr.err = err
-		} else {
-			err = nil
+}
+
+// readPayload reads raw message payload crossing frame boundaries
+func (mr *MessageReader) readPayload(b []byte) (int, error) {
+	for {
+		if mr.frame == nil {
+			if err := mr.nextFrame(); err != nil {
+				return 0, err
+			}
+		}
+		f := mr.frame
+		n, err := f.read(b)
+		if mr.wsc.LogLevel >= LOG_DEBUG {
+			mr.wsc.LogDebug("frame body read: %d", n)
+		}
+		if err == EndOfFrame {
+			if f.Fin {
+				return n, io.EOF
+			}
 			mr.frame = nil
+			continue
 		}
+		return n, err
 	}
-	return n, err
 }
 
+// messageReaderRaw feeds compressed payload to inflater
+type messageReaderRaw struct {
+	mr *MessageReader
+}
+
+func (r messageReaderRaw) Read(b []byte) (int, error) {
+	return r.mr.readPayload(b)
+}
+
+// MessageWriter must be closed, other data messages are blocked until then
 type MessageWriter struct {
-	wsc    *Connection
-	opcode uint8
-	closed bool
+	wsc     *Connection
+	opcode  uint8
+	locked  bool
+	closed  bool
+	pending []byte // held back until compression threshold is reached
+	fw      *flate.Writer
+	fbuf    *bytes.Buffer
+	size    int    // fragment size, zero means a frame per Write
+	buf     []byte // payload of the next fragment
 }
 
 func (wsc *Connection) NewWriter(binary bool) *MessageWriter {
@@ -301,107 +769,358 @@ func (wsc *Connection) NewWriter(binary bool) *MessageWriter {
 	return mw
 }
 
+// NextWriter starts data message, payload is sent in frames of Config.FragmentSize.
+// Message is finished by Close, other data messages wait until then.
+func (wsc *Connection) NextWriter(opcode uint8) io.WriteCloser {
+	if opcode != OPCODE_TEXT && opcode != OPCODE_BINARY {
+		panic(fmt.Sprintf("NextWriter: %d is not data opcode", opcode))
+	}
+	return &MessageWriter{wsc: wsc, opcode: opcode, size: wsc.config.FragmentSize}
+}
+
 func (mw *MessageWriter) Write(b []byte) (int, error) {
 	if mw.closed {
 		return 0, ErrMessageClosed
 	}
-	if mw.wsc.SentClose != nil || mw.wsc.closed {
+	if mw.wsc.hasState(stateCloseSent | stateClosed) {
 		return 0, ErrConnectionClosed
 	}
-	f := newFrame(mw.wsc)
+	mw.lock()
+	ds := mw.wsc.deflate
+	if ds == nil {
+		return mw.emit(b)
+	}
+	if mw.fw == nil {
+		if len(mw.pending)+len(b) < ds.threshold {
+			mw.pending = append(mw.pending, b...)
+			return len(b), nil
+		}
+		mw.fw, mw.fbuf = ds.getWriter()
+		if _, err := mw.fw.Write(mw.pending); err != nil {
+			return 0, err
+		}
+		mw.pending = nil
+	}
+	if _, err := mw.fw.Write(b); err != nil {
+		return 0, err
+	}
+	if mw.fbuf.Len() > 0 {
+		if _, err := mw.emit(mw.fbuf.Bytes()); err != nil {
+			return 0, err
+		}
+		mw.fbuf.Reset()
+	}
+	return len(b), nil
+}
+
+// emit sends payload in frames of fragment size, the rest is buffered
+func (mw *MessageWriter) emit(b []byte) (int, error) {
+	if mw.size == 0 {
+		return mw.writeFrame(b, false)
+	}
+	n := len(b)
+	for len(mw.buf)+len(b) > mw.size {
+		if len(mw.buf) == 0 {
+			if _, err := mw.writeFrame(b[:mw.size], false); err != nil {
+				return 0, err
+			}
+			b = b[mw.size:]
+			continue
+		}
+		k := mw.size - len(mw.buf)
+		mw.buf = append(mw.buf, b[:k]...)
+		b = b[k:]
+		if _, err := mw.writeFrame(mw.buf, false); err != nil {
+			return 0, err
+		}
+		mw.buf = mw.buf[:0]
+	}
+	mw.buf = append(mw.buf, b...)
+	return n, nil
+}
+
+// lock keeps other data messages from interleaving with fragments of this one
+func (mw *MessageWriter) lock() {
+	if !mw.locked {
+		mw.wsc.msgMu.Lock()
+		mw.locked = true
+	}
+}
+
+func (mw *MessageWriter) writeFrame(b []byte, fin bool) (int, error) {
+	mw.wsc.wmu.Lock()
+	defer mw.wsc.wmu.Unlock()
+	if mw.wsc.hasState(stateWriteBroken) {
+		return 0, ErrConnectionBroken
+	}
+	if mw.wsc.hasState(stateCloseSent | stateClosed) {
+		return 0, ErrConnectionClosed
+	}
+	mw.wsc.acquireWriter(mw.wsc.config.WsWriteBuffer)
+	defer mw.wsc.releaseWriter()
+	f := newWriteFrame(mw.wsc)
 	f.Len = len(b)
+	f.Fin = fin
 	f.Opcode = mw.opcode
 	if mw.opcode == OPCODE_TEXT || mw.opcode == OPCODE_BINARY {
+		f.Rsv1 = mw.fw != nil
 		mw.opcode = OPCODE_CONTINUATION
 	}
 	err := f.writeHeader()
 	if err != nil {
 		return 0, err
 	}
-	mw.wsc.LogDebug("frame header sent: %s", f)
 	n, err := f.write(b)
-	mw.wsc.LogDebug("frame body write: %d", n)
+	if mw.wsc.LogLevel >= LOG_DEBUG {
+		mw.wsc.LogDebug("frame sent: %s", f.String())
+	}
+	if err == nil && fin {
+		err = mw.wsc.w.Flush()
+	}
 	return n, err
 }
 
 func (mw *MessageWriter) Close() error {
+	if mw.closed {
+		return ErrMessageClosed
+	}
 	mw.closed = true
-	f := newFrame(mw.wsc)
-	f.Len = 0
-	f.Fin = true
-	f.Opcode = OPCODE_CONTINUATION
-	err := f.writeHeader()
-	if err != nil {
-		return err
+	mw.lock()
+	defer mw.wsc.msgMu.Unlock()
+	b := mw.pending
+	if mw.fw != nil {
+		defer mw.wsc.deflate.putWriter(mw.fw, mw.fbuf)
+		if err := mw.fw.Flush(); err != nil {
+			return err
+		}
+		b = bytes.TrimSuffix(mw.fbuf.Bytes(), deflateTail)
 	}
-	mw.wsc.LogDebug("frame header sent: %s", f)
-	mw.wsc.w.Flush()
-	return nil
+	if mw.size > 0 {
+		if _, err := mw.emit(b); err != nil {
+			return err
+		}
+		b = mw.buf
+	}
+	_, err := mw.writeFrame(b, true)
+	return err
 }
 
 //////////////// Recv - Send interface ////////////////////
 
+// Recv reads next message, pings and pongs are returned as is.
+// Received close frame is echoed and returned as *CloseError.
+// It must not be called concurrently with other reads.
 func (wsc *Connection) Recv() (*Message, error) {
-	if wsc.RcvdClose != nil || wsc.closed {
-		return nil, io.EOF
+	wsc.rmu.Lock()
+	defer wsc.rmu.Unlock()
+	return wsc.recv()
+}
+
+func (wsc *Connection) recv() (msg *Message, err error) {
+	if wsc.hasState(stateReadBroken) {
+		return nil, ErrConnectionBroken
 	}
+	if wsc.hasState(stateCloseRcvd | stateClosed) {
+		return nil, wsc.eof()
+	}
+	defer wsc.releaseReader()
+	defer func() {
+		// the rest of partially read frame would be parsed as the next one
+		if err != nil && wsc.inFrame {
+			wsc.setState(stateReadBroken)
+		}
+	}()
 	for {
-		f := newFrame(wsc)
+		wsc.inFrame = false
+		// parser state is touched only when the frame starts arriving,
+		// so interrupted wait leaves connection usable
+		if err := wsc.waitFrame(); err != nil {
+			return nil, wsc.ka.ioError(err)
+		}
+		wsc.inFrame = true
+		f := newReadFrame(wsc)
 		err := f.readHeader()
 		if err != nil {
-			return nil, err
+			return nil, wsc.ka.ioError(err)
+		}
+		if wsc.LogLevel >= LOG_DEBUG {
+			wsc.LogDebug("frame header received: %s", f.String())
 		}
-		wsc.LogDebug("frame header received: %s", f)
 
-		if (f.Len > wsc.server.Config.MaxMsgLen) ||
-			(f.Opcode == OPCODE_CONTINUATION && wsc.mm != nil && f.Len+wsc.mm.Len() > wsc.server.Config.MaxMsgLen) {
-			wsc.mm = nil
+		if (f.Len > wsc.msgLimit()) ||
+			(f.Opcode == OPCODE_CONTINUATION && wsc.mm != nil && f.Len+wsc.mm.Len() > wsc.msgLimit()) {
+			wsc.dropMessage()
 			return nil, ErrMessageTooLarge
 		}
 
-		b, err := f.recv()
+		var b []byte
+		if f.Opcode == OPCODE_CONTINUATION && wsc.mm != nil {
+			b, err = wsc.mm.appendFrame(&f)
+		} else {
+			b, err = f.recv()
+		}
 		if err != nil {
-			return nil, err
+			return nil, wsc.ka.ioError(err)
 		}
-		wsc.LogDebug("frame body received: %d", len(b))
+		wsc.inFrame = false
 
 		switch f.Opcode {
 		case OPCODE_BINARY, OPCODE_TEXT:
 			if wsc.mm != nil {
+				putBuffer(b)
 				return nil, ErrUnexpectedFrame
 			}
+			if err := wsc.validateText(f.Opcode, f.Rsv1, b, f.Fin); err != nil {
+				putBuffer(b)
+				return nil, err
+			}
 			if f.Fin {
-				return &Message{f.Opcode, b}, nil
+				return wsc.inflate(newMessage(f.Opcode, b), f.Rsv1)
 			} else {
-				wsc.mm = &MultiframeMessage{f.Opcode, nil}
-				wsc.mm.Append(b)
+				wsc.fragmented = MultiframeMessage{Opcode: f.Opcode, Compressed: f.Rsv1, Buf: b}
+				wsc.mm = &wsc.fragmented
 			}
 		case OPCODE_CONTINUATION:
 			if wsc.mm == nil {
+				putBuffer(b)
 				return nil, ErrUnexpectedContinuation
 			}
-			wsc.mm.Append(b)
+			if err := wsc.validateText(wsc.mm.Opcode, wsc.mm.Compressed, b, f.Fin); err != nil {
+				wsc.dropMessage()
+				return nil, err
+			}
 			if f.Fin {
 				m := wsc.mm.AsMessage()
+				compressed := wsc.mm.Compressed
 				wsc.mm = nil
-				return m, nil
+				return wsc.inflate(m, compressed)
 			}
 		case OPCODE_CLOSE:
-			m := &Message{f.Opcode, b}
-			wsc.RcvdClose = m
-			return m, nil
+			if err := validateCloseBody(b, !wsc.config.SkipUTF8Validation); err != nil {
+				return nil, err
+			}
+			return nil, wsc.closeReceived(&Message{f.Opcode, b})
+		case OPCODE_PING, OPCODE_PONG:
+			return newMessage(f.Opcode, b), nil
 		default:
-			return &Message{f.Opcode, b}, nil
+			putBuffer(b)
+			return nil, ErrUnknownOpcode
 		}
 	}
 }
 
+// closeReceived remembers close frame and echoes it, unless close was sent already
+func (wsc *Connection) closeReceived(m *Message) *CloseError {
+	wsc.closeErr = newCloseError(m.Body, !wsc.hasState(stateCloseSent))
+	wsc.RcvdClose = m
+	wsc.setState(stateCloseRcvd)
+	wsc.Send(m)
+	return wsc.closeErr
+}
+
+// eof returns error of reads after close frame or closed socket
+func (wsc *Connection) eof() error {
+	if wsc.closeErr != nil {
+		return wsc.closeErr
+	}
+	return io.EOF
+}
+
+// dropMessage forgets partially received message
+func (wsc *Connection) dropMessage() {
+	if wsc.mm != nil {
+		wsc.mm.release()
+		wsc.mm = nil
+	}
+}
+
+func (wsc *Connection) inflate(m *Message, compressed bool) (*Message, error) {
+	if !compressed {
+		return m, nil
+	}
+	b, err := wsc.deflate.decompress(m.Body, wsc.msgLimit())
+	if err != nil {
+		m.Release()
+		return nil, err
+	}
+	if wsc.LogLevel >= LOG_DEBUG {
+		wsc.LogDebug("message inflated: %d -> %d", len(m.Body), len(b))
+	}
+	putBuffer(m.Body)
+	m.Body = b
+	if m.Opcode == OPCODE_TEXT && !wsc.config.SkipUTF8Validation && !utf8.Valid(b) {
+		m.Release()
+		return nil, ErrInvalidUTF8
+	}
+	return m, nil
+}
+
+// validateText checks next fragment of uncompressed text message,
+// compressed ones are checked after inflate
+func (wsc *Connection) validateText(opcode uint8, compressed bool, b []byte, fin bool) error {
+	if opcode != OPCODE_TEXT || compressed || wsc.config.SkipUTF8Validation {
+		return nil
+	}
+	if !wsc.utf8.feed(b) || (fin && !wsc.utf8.finish()) {
+		wsc.utf8.finish()
+		return ErrInvalidUTF8
+	}
+	return nil
+}
+
+// Send writes message as a single frame, it is safe for concurrent use
 func (wsc *Connection) Send(msg *Message) error {
-	if wsc.SentClose != nil || wsc.closed {
+	if msg.Opcode == OPCODE_TEXT || msg.Opcode == OPCODE_BINARY {
+		wsc.msgMu.Lock()
+		defer wsc.msgMu.Unlock()
+	}
+	wsc.wmu.Lock()
+	defer wsc.wmu.Unlock()
+	return wsc.send(msg)
+}
+
+// send writes message with locks held
+func (wsc *Connection) send(msg *Message) error {
+	if wsc.hasState(stateWriteBroken) {
+		return ErrConnectionBroken
+	}
+	if wsc.hasState(stateCloseSent | stateClosed) {
 		return ErrConnectionClosed
 	}
+	f, body, err := wsc.prepareFrame(msg)
+	if err != nil {
+		return err
+	}
+	if f.Rsv1 {
+		defer putBuffer(body)
+	}
+	if err := wsc.writeFrame(&f, body); err != nil {
+		return err
+	}
+	if wsc.LogLevel >= LOG_DEBUG {
+		wsc.LogDebug("frame sent: %s", f.String())
+	}
+	if msg.Opcode == OPCODE_CLOSE {
+		wsc.sentClose(msg)
+	}
+	return nil
+}
+
+// prepareFrame makes single frame of message, compressed payload is pooled buffer
+func (wsc *Connection) prepareFrame(msg *Message) (Frame, []byte, error) {
 	f := newFrame(wsc)
-	f.Len = len(msg.Body)
+	body := msg.Body
+	if wsc.deflate != nil && (msg.Opcode == OPCODE_TEXT || msg.Opcode == OPCODE_BINARY) && len(body) >= wsc.deflate.threshold {
+		var err error
+		if body, err = wsc.deflate.compress(body); err != nil {
+			return f, nil, err
+		}
+		f.Rsv1 = true
+		if wsc.LogLevel >= LOG_DEBUG {
+			wsc.LogDebug("message deflated: %d -> %d", len(msg.Body), len(body))
+		}
+	}
+	f.Len = len(body)
 	f.Opcode = msg.Opcode
 	if f.Opcode == OPCODE_PING || f.Opcode == OPCODE_PONG || f.Opcode == OPCODE_CLOSE {
 		if f.Len > MaxControlFrameLength {
@@ -409,22 +1128,42 @@ func (wsc *Connection) Send(msg *Message) error {
 		}
 	}
 	f.Fin = true
-	err := f.writeHeader()
-	if err != nil {
-		return err
+	return f, body, nil
+}
+
+// writeFrame writes and flushes the whole frame. Payload larger than write buffer is not copied
+// through it, but goes to socket together with header in one vectored write.
+func (wsc *Connection) writeFrame(f *Frame, body []byte) error {
+	if !f.Mask && len(body) > wsc.config.WsWriteBuffer {
+		fb := getFrameBuffers(wsc.config.WsWriteBuffer)
+		defer putFrameBuffers(fb)
+		if err := fb.add(f, body); err != nil {
+			return err
+		}
+		if err := wsc.flushWriter(); err != nil {
+			return err
+		}
+		return fb.writeTo(wsc.dst)
 	}
-	wsc.LogDebug("frame header sent: %s", f)
-	_, err = f.write(msg.Body)
-	if err != nil {
+	wsc.acquireWriter(wsc.config.WsWriteBuffer)
+	defer wsc.releaseWriter()
+	f.w = wsc.w
+	if err := f.writeHeader(); err != nil {
 		return err
 	}
-	wsc.LogDebug("frame body sent: %d", len(msg.Body))
-	if msg.Opcode == OPCODE_CLOSE {
-		wsc.SentClose = msg
+	if _, err := f.write(body); err != nil {
+		return err
 	}
 	return wsc.w.Flush()
 }
 
+// sentClose is called with wmu held after close frame is written
+func (wsc *Connection) sentClose(msg *Message) {
+	// copy, so that msg stays with the caller
+	wsc.SentClose = &Message{msg.Opcode, msg.Body}
+	wsc.setState(stateCloseSent)
+}
+
 func (wsc *Connection) SendText(b []byte) error {
 	return wsc.Send(&Message{OPCODE_TEXT, b})
 }
@@ -449,29 +1188,81 @@ func (wsc *Connection) SendCloseError(err error) error {
 	return wsc.Send(&Message{OPCODE_CLOSE, BuildCloseBodyError(err)})
 }
 
+// Close closes the socket without closing handshake
 func (wsc *Connection) Close() error {
+	if !wsc.setState(stateClosed) {
+		return ErrConnectionClosed
+	}
 	err := wsc.conn.Close()
-	wsc.closed = true
+	wsc.ka.stop()
 	wsc.LogDebug("socket closed")
+	wsc.stats.disconnect()
+	if wsc.server != nil {
+		wsc.server.trackConn(wsc, false)
+	}
+	wsc.hookMu.Lock()
+	hooks := wsc.closeHooks
+	wsc.closeHooks = nil
+	wsc.hookMu.Unlock()
+	for _, f := range hooks {
+		f()
+	}
+	// parked connection is finished by a worker
+	wsc.wake()
 	return err
 }
 
-func (wsc *Connection) CloseGraceful(code uint16, reason string) error {
-	if wsc.SentClose == nil {
-		if wsc.RcvdClose == nil {
-			_ = wsc.SendClose(code, reason)
-		} else {
-			_ = wsc.Send(wsc.RcvdClose)
+// onClose registers f to be called by Close, f is called right away if connection is closed already
+func (wsc *Connection) onClose(f func()) {
+	wsc.hookMu.Lock()
+	// Close sets the state before it takes the hooks
+	if !wsc.hasState(stateClosed) {
+		wsc.closeHooks = append(wsc.closeHooks, f)
+		wsc.hookMu.Unlock()
+		return
+	}
+	wsc.hookMu.Unlock()
+	f()
+}
+
+// kick sends close frame and closes the socket if peer does not answer within CloseTimeout,
+// connection goroutine (or event loop worker) finishes the rest. The timer is started first,
+// so that close frame stuck behind a blocked write does not keep the connection open.
+func (wsc *Connection) kick(code uint16, reason string) error {
+	time.AfterFunc(wsc.config.CloseTimeout, func() {
+		if !wsc.hasState(stateClosed) {
+			wsc.LogDebug("kick: closing connection forcibly")
+			wsc.conn.Close()
+			wsc.wake()
 		}
+	})
+	return wsc.SendClose(code, reason)
+}
+
+// CloseGraceful sends close frame (or echoes received one), waits for the answer
+// up to CloseTimeout and closes the socket. It is safe for concurrent use:
+// a goroutine blocked in Recv gets the answer, CloseGraceful waits for it to return.
+func (wsc *Connection) CloseGraceful(code uint16, reason string) error {
+	var err error
+	if wsc.hasState(stateCloseRcvd) {
+		err = wsc.Send(wsc.RcvdClose)
+	} else {
+		err = wsc.SendClose(code, reason)
 	}
-	if wsc.RcvdClose == nil {
-		wsc.SetReadDeadlineDuration(wsc.server.Config.CloseTimeout)
-		for {
-			msg, err := wsc.Recv()
-			if err != nil || msg.Opcode == OPCODE_CLOSE {
+	// ErrConnectionClosed means close was already sent, otherwise the peer can't answer
+	if err != nil && err != ErrConnectionClosed {
+		wsc.Close()
+		return err
+	}
+	if !wsc.hasState(stateCloseRcvd | stateClosed) {
+		wsc.SetReadDeadlineDuration(wsc.config.CloseTimeout)
+		wsc.rmu.Lock()
+		for !wsc.hasState(stateCloseRcvd | stateClosed) {
+			if _, err := wsc.recv(); err != nil {
 				break
 			}
 		}
+		wsc.rmu.Unlock()
 	}
 	return wsc.Close()
 }
@@ -482,7 +1273,37 @@ func (wsc *Connection) CloseGracefulError(err error) error {
 
 //////////////// Options ////////////////////
 
+// SetReadLimit overrides Config.MaxMsgLen for this connection
+func (wsc *Connection) SetReadLimit(n int) {
+	wsc.maxMsgLen = n
+}
+
+func (wsc *Connection) msgLimit() int {
+	if wsc.maxMsgLen > 0 {
+		return wsc.maxMsgLen
+	}
+	return wsc.config.MaxMsgLen
+}
+
+// deadlines are remembered to be restored after context cancellation
+
+func storeDeadline(addr *int64, t time.Time) {
+	var ns int64
+	if !t.IsZero() {
+		ns = t.UnixNano()
+	}
+	atomic.StoreInt64(addr, ns)
+}
+
+func loadDeadline(addr *int64) time.Time {
+	if ns := atomic.LoadInt64(addr); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
 func (wsc *Connection) SetReadDeadline(t time.Time) error {
+	storeDeadline(&wsc.rdeadline, t)
 	return wsc.conn.SetReadDeadline(t)
 }
 
@@ -491,10 +1312,11 @@ func (wsc *Connection) SetReadDeadlineDuration(d time.Duration) error {
 	if d > 0 {
 		t = time.Now().Add(d)
 	}
-	return wsc.conn.SetReadDeadline(t)
+	return wsc.SetReadDeadline(t)
 }
 
 func (wsc *Connection) SetWriteDeadline(t time.Time) error {
+	storeDeadline(&wsc.wdeadline, t)
 	return wsc.conn.SetWriteDeadline(t)
 }
 
@@ -503,7 +1325,7 @@ func (wsc *Connection) SetWriteDeadlineDuration(d time.Duration) error {
 	if d > 0 {
 		t = time.Now().Add(d)
 	}
-	return wsc.conn.SetWriteDeadline(t)
+	return wsc.SetWriteDeadline(t)
 }
 
 //////////////// Logging ////////////////////
@@ -522,13 +1344,22 @@ var logNames map[uint8]string = map[uint8]string{
 	LOG_DEBUG: "DEBUG",
 }
 
+// Log passes formatted message to connection logger with remote address and id fields
 func (wsc *Connection) Log(level uint8, format string, args ...interface{}) {
 	if level > wsc.LogLevel {
 		return
 	}
-	addr := wsc.conn.RemoteAddr().String()
-	msg := fmt.Sprintf("%s %s: ", addr, logNames[level]) + fmt.Sprintf(format, args...)
-	log.Println(msg)
+	wsc.logger.Log(level, fmt.Sprintf(format, args...), "remote", wsc.conn.RemoteAddr().String(), "id", wsc.id)
+}
+
+// SetLogger overrides Config.Logger for the connection, e.g. to add fields with LoggerWith.
+// It should be called from HandshakeFunc or before handler is run.
+func (wsc *Connection) SetLogger(l Logger) {
+	wsc.logger = l
+}
+
+func (wsc *Connection) Logger() Logger {
+	return wsc.logger
 }
 
 func (wsc *Connection) LogError(fmt string, args ...interface{}) {
@@ -0,0 +1,462 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer serves handler on loopback, it returns server and its address
+func newTestServer(tb testing.TB, config Config, handler HandlerFunc) (*Server, string) {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	// 4KB socket buffers of default config make loopback crawl on delayed acks
+	if config.SockReadBuffer == 0 {
+		config.SockReadBuffer = 256 * 1024
+	}
+	if config.SockWriteBuffer == 0 {
+		config.SockWriteBuffer = 256 * 1024
+	}
+	config.Handshake = func(wsc *Connection, req *http.Request, w http.ResponseWriter) HandlerFunc {
+		return handler
+	}
+	s := NewServer(config)
+	go s.ServeListener(ln)
+	tb.Cleanup(func() {
+		ln.Close()
+	})
+	return s, ln.Addr().String()
+}
+
+// dialTest connects client to test server, it is closed when the test ends
+func dialTest(tb testing.TB, addr string, config Config) *Connection {
+	tb.Helper()
+	if config.SockReadBuffer == 0 {
+		config.SockReadBuffer = 256 * 1024
+	}
+	if config.SockWriteBuffer == 0 {
+		config.SockWriteBuffer = 256 * 1024
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cli, err := Dial(ctx, "ws://"+addr, DialConfig{Config: config, Stats: newStats()})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		cli.Close()
+	})
+	return cli
+}
+
+// waitFor polls cond until it is true
+func waitFor(tb testing.TB, what string, cond func() bool) {
+	tb.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			tb.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// newTestPair connects client to server over loopback, server connection is held
+// by its handler until the test ends
+func newTestPair(tb testing.TB, config Config) (srv, cli *Connection) {
+	tb.Helper()
+	conns := make(chan *Connection, 1)
+	done := make(chan struct{})
+	_, addr := newTestServer(tb, config, func(wsc *Connection) error {
+		conns <- wsc
+		<-done
+		return nil
+	})
+	cli = dialTest(tb, addr, config)
+	srv = <-conns
+	// registered after dialTest, so that handler returns before client is closed
+	tb.Cleanup(func() {
+		close(done)
+	})
+	return srv, cli
+}
+
+func TestControlBetweenFragments(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		size   int
+		send   func(wsc *Connection) error
+	}{
+		{
+			name: "batch",
+			size: 5000,
+			send: func(wsc *Connection) error {
+				return wsc.SendBatch([]*Message{{OPCODE_PING, []byte("p")}})
+			},
+		},
+		{
+			name:   "vectored ping",
+			config: Config{WsWriteBuffer: 64, FragmentSize: 300},
+			size:   1000,
+			send: func(wsc *Connection) error {
+				return wsc.SendPing(bytes.Repeat([]byte("p"), 100))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, cli := newTestPair(t, tt.config)
+			payload := bytes.Repeat([]byte("0123456789"), tt.size/10)
+			errs := make(chan error, 1)
+			go func() {
+				w := srv.NextWriter(OPCODE_BINARY)
+				if _, err := w.Write(payload); err != nil {
+					errs <- err
+					return
+				}
+				if err := tt.send(srv); err != nil {
+					errs <- err
+					return
+				}
+				errs <- w.Close()
+			}()
+			m, err := cli.Recv()
+			if err != nil {
+				t.Fatalf("recv ping: %s", err)
+			}
+			if m.Opcode != OPCODE_PING {
+				t.Fatalf("got %s, ping expected", m)
+			}
+			m, err = cli.Recv()
+			if err != nil {
+				t.Fatalf("recv message: %s", err)
+			}
+			if m.Opcode != OPCODE_BINARY || !bytes.Equal(m.Body, payload) {
+				t.Fatalf("got %s, %d bytes of payload expected", m, len(payload))
+			}
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// stressBody is "sender:seq:" followed by filler of the sender, so that interleaved frames are detected
+func stressBody(sender, seq, size int) []byte {
+	b := []byte(fmt.Sprintf("%02d:%06d:", sender, seq))
+	for len(b) < size {
+		b = append(b, byte('a'+sender))
+	}
+	return b
+}
+
+func parseStressBody(b []byte) (sender, seq int, err error) {
+	if _, err := fmt.Sscanf(string(b), "%02d:%06d:", &sender, &seq); err != nil {
+		return 0, 0, err
+	}
+	for _, c := range b[10:] {
+		if c != byte('a'+sender) {
+			return 0, 0, fmt.Errorf("sender %d: foreign byte %q", sender, c)
+		}
+	}
+	return sender, seq, nil
+}
+
+func TestConcurrentSend(t *testing.T) {
+	const senders = 16
+	const messages = 300
+	srv, cli := newTestPair(t, Config{FragmentSize: 512})
+
+	var received sync.WaitGroup
+	received.Add(1)
+	half := make(chan struct{})
+	var readErr error
+	go func() {
+		defer received.Done()
+		last := make([]int, senders)
+		for i := range last {
+			last[i] = -1
+		}
+		n := 0
+		for {
+			m, err := cli.Recv()
+			var ce *CloseError
+			if errors.As(err, &ce) {
+				return
+			}
+			if err == nil {
+				sender, seq, perr := parseStressBody(m.Body)
+				switch {
+				case perr != nil:
+					err = fmt.Errorf("%s: %w", m, perr)
+				case sender >= senders || seq <= last[sender]:
+					err = fmt.Errorf("sender %d: message %d out of order", sender, seq)
+				default:
+					last[sender] = seq
+				}
+				m.Release()
+			}
+			if err != nil {
+				// unblock senders and closers
+				readErr = err
+				srv.Close()
+				if n < senders*messages/2 {
+					close(half)
+				}
+				return
+			}
+			if n++; n == senders*messages/2 {
+				close(half)
+			}
+		}
+	}()
+
+	// senders of fragmented messages run along with the others,
+	// so that frames of Send and SendPing try to get between fragments
+	var sent sync.WaitGroup
+	sendErrs := make(chan error, senders)
+	for g := 0; g < senders; g++ {
+		sent.Add(1)
+		go func(g int) {
+			defer sent.Done()
+			for i := 0; i < messages; i++ {
+				var err error
+				switch g % 4 {
+				case 0:
+					err = srv.SendBinary(stressBody(g, i, 1+(i*37)%3000))
+				case 1:
+					err = srv.SendText(stressBody(g, i, 1+(i*53)%700))
+				case 2:
+					err = srv.SendPing(stressBody(g, i, MaxControlFrameLength))
+				case 3:
+					w := srv.NextWriter(OPCODE_BINARY)
+					b := stressBody(g, i, 2000)
+					for len(b) > 0 && err == nil {
+						k := 100
+						if k > len(b) {
+							k = len(b)
+						}
+						_, err = w.Write(b[:k])
+						b = b[k:]
+						runtime.Gosched()
+					}
+					if cerr := w.Close(); err == nil {
+						err = cerr
+					}
+				}
+				if err == ErrConnectionClosed {
+					return
+				}
+				if err != nil {
+					sendErrs <- err
+					return
+				}
+			}
+		}(g)
+	}
+
+	// close while senders are still running
+	<-half
+	var closed sync.WaitGroup
+	closeErrs := make(chan error, senders)
+	for g := 0; g < senders/2; g++ {
+		closed.Add(1)
+		go func() {
+			defer closed.Done()
+			if err := srv.CloseGraceful(STATUS_OK, "done"); err != nil && err != ErrConnectionClosed {
+				closeErrs <- err
+			}
+		}()
+	}
+	sent.Wait()
+	closed.Wait()
+	received.Wait()
+	close(sendErrs)
+	close(closeErrs)
+	// send errors follow the broken read
+	if readErr != nil {
+		t.Fatalf("recv: %s", readErr)
+	}
+	for err := range sendErrs {
+		t.Errorf("send: %s", err)
+	}
+	for err := range closeErrs {
+		t.Errorf("close: %s", err)
+	}
+	if srv.SentClose == nil || !srv.hasState(stateClosed) {
+		t.Errorf("connection is not closed gracefully")
+	}
+}
+
+func BenchmarkSend(b *testing.B) {
+	srv, cli := newTestPair(b, Config{})
+	go io.Copy(io.Discard, cli.conn)
+	msg := &Message{OPCODE_BINARY, bytes.Repeat([]byte("x"), 1024)}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg.Body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := srv.Send(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// maskedFrames encodes n client frames of binary message with payload of size bytes
+func maskedFrames(n, size int) []byte {
+	key := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x80 | OPCODE_BINARY, 0x80 | 126, byte(size >> 8), byte(size)}
+	frame = append(frame, key[:]...)
+	for i := 0; i < size; i++ {
+		frame = append(frame, 'x'^key[i%4])
+	}
+	return bytes.Repeat(frame, n)
+}
+
+func BenchmarkRecv(b *testing.B) {
+	const size = 1024
+	srv, cli := newTestPair(b, Config{})
+	frames := maskedFrames(64, size)
+	// the client socket is written directly, it is closed at the end of the benchmark
+	go func() {
+		for {
+			if _, err := cli.conn.Write(frames); err != nil {
+				return
+			}
+		}
+	}()
+	b.ReportAllocs()
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m, err := srv.Recv()
+		if err != nil {
+			b.Fatal(err)
+		}
+		m.Release()
+	}
+}
+
+// echo by server, client frames are masked
+func BenchmarkRoundTrip(b *testing.B) {
+	srv, cli := newTestPair(b, Config{})
+	go func() {
+		for {
+			m, err := srv.Recv()
+			if err != nil {
+				return
+			}
+			srv.Send(m)
+			m.Release()
+		}
+	}()
+	msg := &Message{OPCODE_BINARY, bytes.Repeat([]byte("x"), 1024)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := cli.Send(msg); err != nil {
+			b.Fatal(err)
+		}
+		m, err := cli.Recv()
+		if err != nil {
+			b.Fatal(err)
+		}
+		m.Release()
+	}
+}
+
+// idleConn is a socket without data, reads block until the benchmark ends
+type idleConn struct {
+	done    chan struct{}
+	waiting *int64
+}
+
+var idleAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	atomic.AddInt64(c.waiting, 1)
+	<-c.done
+	return 0, net.ErrClosed
+}
+
+func (c *idleConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c *idleConn) Close() error                       { return nil }
+func (c *idleConn) LocalAddr() net.Addr                { return idleAddr }
+func (c *idleConn) RemoteAddr() net.Addr               { return idleAddr }
+func (c *idleConn) SetDeadline(t time.Time) error      { return nil }
+func (c *idleConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *idleConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// memory held by connections waiting for data, without kernel sockets.
+// The baseline holds read and write buffers per connection, as it was before they were pooled.
+func BenchmarkIdleConnections(b *testing.B) {
+	s := NewServer(Config{Handshake: func(*Connection, *http.Request, http.ResponseWriter) HandlerFunc { return nil }})
+	// runtime reuses descriptors of finished goroutines, they are allocated beforehand
+	// so that the first case does not pay for them
+	var started sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < idleConns; i++ {
+		started.Add(1)
+		go func() {
+			started.Done()
+			<-done
+		}()
+	}
+	started.Wait()
+	close(done)
+	b.Run("Pooled", func(b *testing.B) {
+		benchmarkIdle(b, s, func(wsc *Connection) {
+			wsc.Recv()
+		})
+	})
+	b.Run("PerConnectionBuffers", func(b *testing.B) {
+		benchmarkIdle(b, s, func(wsc *Connection) {
+			r := bufio.NewReaderSize(wsc.conn, s.Config.WsReadBuffer)
+			w := bufio.NewWriterSize(wsc.conn, s.Config.WsWriteBuffer)
+			r.ReadByte()
+			runtime.KeepAlive(w)
+		})
+	})
+}
+
+const idleConns = 100000
+
+func benchmarkIdle(b *testing.B, s *Server, wait func(wsc *Connection)) {
+	for i := 0; i < b.N; i++ {
+		done := make(chan struct{})
+		var waiting int64
+		var finished sync.WaitGroup
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		for j := 0; j < idleConns; j++ {
+			wsc := newConnection(s, &idleConn{done: done, waiting: &waiting})
+			finished.Add(1)
+			go func() {
+				defer finished.Done()
+				wait(wsc)
+			}()
+		}
+		for atomic.LoadInt64(&waiting) < idleConns {
+			time.Sleep(10 * time.Millisecond)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		close(done)
+		finished.Wait()
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/idleConns, "heap-B/conn")
+		b.ReportMetric(float64(after.StackInuse-before.StackInuse)/idleConns, "stack-B/conn")
+	}
+}
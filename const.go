@@ -1,6 +1,7 @@
 package websocket
 
 import (
+	"compress/flate"
 	"errors"
 	"time"
 )
@@ -8,17 +9,22 @@ import (
 const (
 	KeyMagic                     = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
 	DefaultMaxMsgLen             = 1024 * 1024
+	DefaultFragmentSize          = 4 * 1024
 	DefaultSockReadBuffer        = 4 * 1024
 	DefaultSockWriteBuffer       = 4 * 1024
 	DefaultHttpReadBuffer        = 4 * 1024
 	DefaultHttpWriteBuffer       = 4 * 1024
 	DefaultWsReadBuffer          = 4 * 1024
 	DefaultWsWriteBuffer         = 4 * 1024
+	DefaultEventWorkersPerCPU    = 4
+	DefaultHubQueueLen           = 16
 	MaxControlFrameLength        = 125
 	AcceptErrorTimeout           = time.Second
 	DefaultCloseTimeout          = 5 * time.Second
 	DefaultHandshakeReadTimeout  = 3 * time.Second
 	DefaultHandshakeWriteTimeout = 3 * time.Second
+	DefaultCompressionLevel      = flate.BestSpeed
+	DefaultCompressionThreshold  = 512
 )
 
 const (
@@ -28,6 +34,7 @@ const (
 	OPCODE_CLOSE        = 8
 	OPCODE_PING         = 9
 	OPCODE_PONG         = 10
+	maxOpcode           = 0x0f
 )
 
 var KnownOpcodes []uint8 = []uint8{
@@ -68,10 +75,25 @@ var (
 	EndOfMessage              = errors.New("end of message")
 	ErrBadFrame               = errors.New("bad frame")
 	ErrUnmaskedFrame          = errors.New("unmasked frame")
+	ErrMaskedFrame            = errors.New("masked frame")
 	ErrUnexpectedFrame        = errors.New("unexpected text/binary frame in sequence")
 	ErrUnexpectedContinuation = errors.New("unexpected continuation frame")
 	ErrUnknownOpcode          = errors.New("frame with unknown opcode")
+	ErrReservedBits           = errors.New("frame with reserved bits set")
+	ErrFragmentedControl      = errors.New("fragmented control frame")
+	ErrControlTooLong         = errors.New("control frame too long")
+	ErrNonMinimalLength       = errors.New("frame length is not minimally encoded")
+	ErrBadCloseBody           = errors.New("invalid close frame body")
+	ErrBadCloseCode           = errors.New("invalid close code")
+	ErrPeerTimeout            = errors.New("peer timeout")
+	ErrConnectionBroken       = errors.New("connection broken by interrupted i/o")
 	ErrMessageTooLarge        = errors.New("message too large")
 	ErrConnectionClosed       = errors.New("connection already closed")
 	ErrMessageClosed          = errors.New("message already closed")
+	ErrBadCompression         = errors.New("bad compressed data")
+	ErrInvalidUTF8            = errors.New("invalid utf-8 in text message")
+	ErrBadHandshake           = errors.New("bad handshake")
+	ErrServerClosed           = errors.New("server closed")
+	ErrUnknownConnection      = errors.New("unknown connection")
+	ErrRateLimited            = errors.New("rate limit exceeded")
 )
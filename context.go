@@ -0,0 +1,106 @@
+package websocket
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// lockContext acquires mu unless ctx is done first
+func lockContext(ctx context.Context, mu *sync.Mutex) error {
+	if mu.TryLock() {
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		mu.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		// the lock is released as soon as it is acquired
+		go func() {
+			<-locked
+			mu.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// interrupt breaks pending i/o by setting deadline in the past when ctx is done,
+// returned stop function reports whether it happened
+func interrupt(ctx context.Context, setDeadline func(time.Time) error) (stop func() bool) {
+	stopc := make(chan struct{})
+	fired := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			setDeadline(aLongTimeAgo)
+			fired <- true
+		case <-stopc:
+			fired <- false
+		}
+	}()
+	return func() bool {
+		close(stopc)
+		return <-fired
+	}
+}
+
+// RecvContext is Recv which returns ctx.Err() when ctx is done.
+// If ctx is done while waiting for the next frame the connection stays usable,
+// if frame was partially read further reads return ErrConnectionBroken.
+func (wsc *Connection) RecvContext(ctx context.Context) (*Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := lockContext(ctx, &wsc.rmu); err != nil {
+		return nil, err
+	}
+	defer wsc.rmu.Unlock()
+	if ctx.Done() == nil {
+		return wsc.recv()
+	}
+	stop := interrupt(ctx, wsc.conn.SetReadDeadline)
+	msg, err := wsc.recv()
+	if stop() {
+		wsc.conn.SetReadDeadline(loadDeadline(&wsc.rdeadline))
+		if err != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return msg, err
+}
+
+// SendContext is Send which returns ctx.Err() when ctx is done.
+// If ctx is done in the middle of writing further writes return ErrConnectionBroken.
+func (wsc *Connection) SendContext(ctx context.Context, msg *Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if msg.Opcode == OPCODE_TEXT || msg.Opcode == OPCODE_BINARY {
+		if err := lockContext(ctx, &wsc.msgMu); err != nil {
+			return err
+		}
+		defer wsc.msgMu.Unlock()
+	}
+	if err := lockContext(ctx, &wsc.wmu); err != nil {
+		return err
+	}
+	defer wsc.wmu.Unlock()
+	if ctx.Done() == nil {
+		return wsc.send(msg)
+	}
+	stop := interrupt(ctx, wsc.conn.SetWriteDeadline)
+	err := wsc.send(msg)
+	if stop() {
+		wsc.conn.SetWriteDeadline(loadDeadline(&wsc.wdeadline))
+		if err != nil {
+			wsc.setState(stateWriteBroken)
+			return ctx.Err()
+		}
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+package websocket
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRecvContext(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		send   func(cli *Connection) error
+		err    error
+		broken bool
+	}{
+		{
+			name: "cancel while idle",
+			send: func(cli *Connection) error { return nil },
+			err:  context.DeadlineExceeded,
+		},
+		{
+			name: "cancel mid-frame",
+			send: func(cli *Connection) error {
+				// masked header of 100 bytes frame followed by a part of payload
+				_, err := cli.conn.Write([]byte{0x82, 0x80 | 100, 1, 2, 3, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+				return err
+			},
+			err:    context.DeadlineExceeded,
+			broken: true,
+		},
+		{
+			name:   "payload left unread",
+			limit:  10,
+			send:   func(cli *Connection) error { return cli.SendBinary(make([]byte, 100)) },
+			err:    ErrMessageTooLarge,
+			broken: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, cli := newTestPair(t, Config{})
+			if tt.limit > 0 {
+				srv.SetReadLimit(tt.limit)
+			}
+			if err := tt.send(cli); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			if _, err := srv.RecvContext(ctx); err != tt.err {
+				t.Fatalf("err = %v, %v expected", err, tt.err)
+			}
+			if tt.broken {
+				if _, err := srv.Recv(); err != ErrConnectionBroken {
+					t.Errorf("err = %v, %v expected", err, ErrConnectionBroken)
+				}
+				return
+			}
+			// the next message is received as usual
+			if err := cli.SendText([]byte("next")); err != nil {
+				t.Fatal(err)
+			}
+			m, err := srv.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Opcode != OPCODE_TEXT || string(m.Body) != "next" {
+				t.Errorf("got %s, next message expected", m)
+			}
+		})
+	}
+}
@@ -41,6 +41,8 @@ func main() {
 		SockWriteBuffer: 4 * 1024 * 1024,
 		IOStatistics:    true,
 		LogLevel:        websocket.LOG_INFO,
+		// demo page is opened from file system
+		CheckOrigin: func(*http.Request) bool { return true },
 	})
 	log.Fatalln(server.Serve())
 }
@@ -1,85 +1,37 @@
 package main
 
 import (
+	"errors"
 	websocket "go-light-websocket"
 	"io"
 	"log"
 	"net/http"
-	"sync"
 )
 
-var registry map[string]chan *websocket.Message = make(map[string]chan *websocket.Message)
-var regMutex sync.Mutex
+// messages are queued per connection, the oldest ones are dropped if client does not read
+var hub = websocket.NewHub(websocket.HubConfig{QueueLen: tubeLen, Policy: websocket.DropOldest})
 
 const tubeLen = 4
 
-func reader(wsc *websocket.Connection, wc chan *websocket.Message) {
-	defer close(wc)
+// messages are pushed by hub, handler just answers pings and waits for close
+func handler(wsc *websocket.Connection) error {
 	for {
 		msg, err := wsc.Recv()
 		if err != nil {
-			if err != io.EOF {
-				wsc.LogError("reader: ", err.Error())
+			// close frame is echoed by Recv
+			var ce *websocket.CloseError
+			if err != io.EOF && !errors.As(err, &ce) {
+				wsc.LogError("reader: %s", err)
 			}
-			return
+			return nil
 		}
-		switch msg.Opcode {
-		case websocket.OPCODE_PING:
-			msg.Opcode = websocket.OPCODE_PONG
-			wc <- msg
-		case websocket.OPCODE_CLOSE:
-			wc <- msg
-			return
-		}
-	}
-}
-
-func writer(wsc *websocket.Connection, wc, t chan *websocket.Message) {
-	defer wsc.Close()
-	for {
-		select {
-		case msg := <-t:
-			err := wsc.Send(msg)
-			if err != nil {
-				wsc.LogError("writer: ", err.Error())
-				return
-			}
-		case msg, ok := <-wc:
-			if !ok {
-				wsc.LogDebug("writer: reader closed signal")
-				return
-			}
-			err := wsc.Send(msg)
-			if err != nil {
-				wsc.LogError("writer: ", err.Error())
-				return
-			}
-			if msg.Opcode == websocket.OPCODE_CLOSE {
-				return
+		if msg.Opcode == websocket.OPCODE_PING {
+			if err := wsc.SendPong(msg.Body); err != nil {
+				return err
 			}
 		}
+		msg.Release()
 	}
-	return
-}
-
-func handler(wsc *websocket.Connection, id string) error {
-	regMutex.Lock()
-	t, ok := registry[id]
-	if !ok {
-		t = make(chan *websocket.Message, tubeLen)
-		registry[id] = t
-	}
-	regMutex.Unlock()
-
-	wc := make(chan *websocket.Message)
-	go reader(wsc, wc)
-	writer(wsc, wc, t)
-
-	regMutex.Lock()
-	delete(registry, id)
-	regMutex.Unlock()
-
-	return nil
 }
 
 func handshake(wsc *websocket.Connection, req *http.Request, rspw http.ResponseWriter) websocket.HandlerFunc {
@@ -89,9 +41,7 @@ func handshake(wsc *websocket.Connection, req *http.Request, rspw http.ResponseW
 		rspw.Write([]byte("no_id"))
 		return nil
 	}
-	return func(wsc *websocket.Connection) error {
-		return handler(wsc, id)
-	}
+	return hub.Wrap(handler, id)
 }
 
 func respond(w http.ResponseWriter, status int, msg string) {
@@ -109,12 +59,7 @@ func put(w http.ResponseWriter, r *http.Request) {
 	}
 	msg := r.FormValue("msg")
 
-	regMutex.Lock()
-	t := registry[id]
-	regMutex.Unlock()
-
-	if t != nil {
-		t <- &websocket.Message{websocket.OPCODE_TEXT, []byte(msg)}
+	if hub.Publish(id, &websocket.Message{websocket.OPCODE_TEXT, []byte(msg)}) > 0 {
 		respond(w, 200, "ok")
 	} else {
 		respond(w, 200, "offline")
@@ -128,6 +73,8 @@ func main() {
 		Addr:      ":1234",
 		Handshake: handshake,
 		LogLevel:  websocket.LOG_DEBUG,
+		// demo page is opened from file system
+		CheckOrigin: func(*http.Request) bool { return true },
 	})
 	go func() {
 		log.Fatalln(wsServer.Serve())
@@ -0,0 +1,252 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// EventHandlerFunc is called for every received data message,
+// the message belongs to the handler. Returned error closes the connection.
+type EventHandlerFunc func(wsc *Connection, msg *Message) error
+
+// returned by handler which handed connection over to event loop
+var errParked = errors.New("connection parked")
+
+// WrapEventHandler makes callback-style handler. Pings are answered and close is echoed internally.
+// With Config.EventLoop idle connection is parked between messages without goroutine
+// and read buffer, handler is run by a pool of Config.EventWorkers goroutines.
+// Otherwise (or if connection can't be polled, e.g. TLS) messages are read in a loop as usual.
+func WrapEventHandler(h EventHandlerFunc) HandlerFunc {
+	var handler HandlerFunc
+	handler = func(wsc *Connection) error {
+		for {
+			if wsc.park(handler) {
+				return errParked
+			}
+			msg, err := wsc.Recv()
+			if err != nil {
+				var ce *CloseError
+				if err != io.EOF && !errors.As(err, &ce) {
+					wsc.SendCloseError(err)
+				}
+				return err
+			}
+			switch msg.Opcode {
+			case OPCODE_PING:
+				err = wsc.SendPong(msg.Body)
+				msg.Release()
+			case OPCODE_PONG:
+				msg.Release()
+			default:
+				err = h(wsc, msg)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return handler
+}
+
+// poller waits for readable sockets, implemented for linux only
+type poller interface {
+	add(id uint64, rc syscall.RawConn) error
+	rearm(id uint64, rc syscall.RawConn) error
+	wait(ready func(id uint64)) error
+	close() // stops wait and releases poller once it returns
+}
+
+type eventLoop struct {
+	poller  poller
+	tasks   chan *Connection
+	mu      sync.Mutex
+	conns   map[uint64]*Connection
+	stopMu  sync.RWMutex // held for reading while poller or tasks are used
+	stopped bool
+	once    sync.Once
+}
+
+var errLoopStopped = errors.New("event loop stopped")
+
+func newEventLoop(config *Config) (*eventLoop, error) {
+	p, err := newPoller()
+	if err != nil {
+		return nil, err
+	}
+	l := &eventLoop{
+		poller: p,
+		tasks:  make(chan *Connection, config.EventWorkers),
+		conns:  make(map[uint64]*Connection),
+	}
+	for i := 0; i < config.EventWorkers; i++ {
+		go l.worker()
+	}
+	go func() {
+		if err := p.wait(l.ready); err != nil {
+			config.Logger.Log(LOG_ERROR, "event loop stopped", "err", err)
+		}
+	}()
+	return l, nil
+}
+
+func (l *eventLoop) worker() {
+	for wsc := range l.tasks {
+		wsc.resume()
+	}
+}
+
+func (l *eventLoop) ready(id uint64) {
+	l.mu.Lock()
+	wsc := l.conns[id]
+	l.mu.Unlock()
+	// socket may be closed and its descriptor reused since the event
+	if wsc != nil {
+		wsc.wake()
+	}
+}
+
+// register adds connection to the loop before it is parked the first time,
+// so that wake and finish never see it half registered
+func (l *eventLoop) register(wsc *Connection) bool {
+	l.stopMu.RLock()
+	defer l.stopMu.RUnlock()
+	if l.stopped {
+		return false
+	}
+	l.mu.Lock()
+	l.conns[wsc.id] = wsc
+	l.mu.Unlock()
+	wsc.polled = true
+	return true
+}
+
+// arm waits for the next readable event of registered connection,
+// first is true if socket is not in poller yet
+func (l *eventLoop) arm(id uint64, raw syscall.RawConn, first bool) error {
+	l.stopMu.RLock()
+	defer l.stopMu.RUnlock()
+	if l.stopped {
+		return errLoopStopped
+	}
+	if first {
+		return l.poller.add(id, raw)
+	}
+	return l.poller.rearm(id, raw)
+}
+
+// dispatch passes woken connection to a worker
+func (l *eventLoop) dispatch(wsc *Connection) {
+	l.stopMu.RLock()
+	defer l.stopMu.RUnlock()
+	if !l.stopped {
+		select {
+		case l.tasks <- wsc:
+			return
+		default:
+		}
+	}
+	// all workers are busy, callers (poller, timers, other handlers) must not wait for them
+	go wsc.resume()
+}
+
+// remove forgets finished connection, closed socket leaves epoll by itself
+func (l *eventLoop) remove(wsc *Connection) {
+	l.mu.Lock()
+	delete(l.conns, wsc.id)
+	l.mu.Unlock()
+}
+
+// stop closes poller and lets workers exit once queued connections are resumed,
+// connections woken later get a goroutine each. It may be called many times.
+func (l *eventLoop) stop() {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() {
+		l.stopMu.Lock()
+		l.stopped = true
+		close(l.tasks)
+		l.stopMu.Unlock()
+		l.poller.close()
+	})
+}
+
+// park hands idle connection over to event loop.
+// It returns false if connection must be read right away.
+func (wsc *Connection) park(handler HandlerFunc) bool {
+	if !wsc.runner || wsc.server == nil || wsc.server.loop == nil {
+		return false
+	}
+	// woken connection has data in the socket
+	if wsc.resumed {
+		wsc.resumed = false
+		return false
+	}
+	l := wsc.server.loop
+	wsc.rmu.Lock()
+	// read buffer is kept only while it has data
+	if wsc.r != nil || wsc.mm != nil || wsc.reader != nil || wsc.hasState(stateCloseRcvd|stateClosed) {
+		wsc.rmu.Unlock()
+		return false
+	}
+	if wsc.raw == nil {
+		// wrapped connections (TLS etc) may keep data read from the socket
+		sc, ok := wsc.conn.(syscall.Conn)
+		if !ok {
+			wsc.rmu.Unlock()
+			return false
+		}
+		raw, err := sc.SyscallConn()
+		if err != nil {
+			wsc.rmu.Unlock()
+			return false
+		}
+		wsc.raw = raw
+	}
+	wsc.rmu.Unlock()
+
+	first := !wsc.polled
+	if first && !l.register(wsc) {
+		return false
+	}
+	wsc.handler = handler
+	wsc.runner = false
+	wsc.shard.park()
+	// connection may be resumed by wake right after the store, so it is not touched till arm fails
+	id, raw := wsc.id, wsc.raw
+	atomic.StoreUint32(&wsc.parked, 1)
+	if err := l.arm(id, raw, first); err != nil {
+		// socket is closed, handler gets the error from Recv
+		if atomic.CompareAndSwapUint32(&wsc.parked, 1, 0) {
+			wsc.shard.wake()
+			wsc.runner = true
+			return false
+		}
+	}
+	return true
+}
+
+// wake passes parked connection to a worker, other connections are left as is
+func (wsc *Connection) wake() bool {
+	if !atomic.CompareAndSwapUint32(&wsc.parked, 1, 0) {
+		return false
+	}
+	wsc.shard.wake()
+	wsc.server.loop.dispatch(wsc)
+	return true
+}
+
+// resume runs handler of woken connection
+func (wsc *Connection) resume() {
+	detached := false
+	defer func() {
+		if !detached {
+			wsc.finish(recover())
+		}
+	}()
+	wsc.resumed = true
+	detached = wsc.run(wsc.handler)
+}
@@ -0,0 +1,182 @@
+//go:build linux
+
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newEventServer serves echo over event loop with few workers, so that they are shared by connections
+func newEventServer(t *testing.T, config Config) (*Server, string) {
+	config.EventLoop = true
+	config.EventWorkers = 2
+	return newTestServer(t, config, WrapEventHandler(func(wsc *Connection, msg *Message) error {
+		err := wsc.Send(msg)
+		msg.Release()
+		return err
+	}))
+}
+
+// waitParked waits till n connections are parked in event loop
+func waitParked(t *testing.T, s *Server, n uint64) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("%d parked connections", n), func() bool {
+		ss := s.Stats.Snapshot()
+		return ss.ConnectionsParked == n && ss.Connections == n
+	})
+}
+
+// waitFinished waits till all connections leave server and event loop
+func waitFinished(t *testing.T, s *Server) {
+	t.Helper()
+	waitFor(t, "connections to finish", func() bool {
+		ss := s.Stats.Snapshot()
+		return ss.ConnectionsParked == 0 && ss.Connections == 0 && s.Count() == 0
+	})
+}
+
+func TestEventLoopEcho(t *testing.T) {
+	const clients = 8
+	const messages = 50
+	s, addr := newEventServer(t, Config{})
+	clis := make([]*Connection, clients)
+	for i := range clis {
+		clis[i] = dialTest(t, addr, Config{})
+	}
+	waitParked(t, s, clients)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i, cli := range clis {
+		wg.Add(1)
+		go func(i int, cli *Connection) {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				body := stressBody(i, j, 1+(j*131)%5000)
+				if err := cli.SendBinary(body); err != nil {
+					errs <- err
+					return
+				}
+				m, err := cli.Recv()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if m.Opcode != OPCODE_BINARY || !bytes.Equal(m.Body, body) {
+					errs <- fmt.Errorf("client %d: got %s, message %d expected", i, m, j)
+					return
+				}
+				m.Release()
+			}
+			// answered internally, handler is not called
+			if err := cli.SendPing([]byte("ping")); err != nil {
+				errs <- err
+				return
+			}
+			if m, err := cli.Recv(); err != nil || m.Opcode != OPCODE_PONG {
+				errs <- fmt.Errorf("client %d: got %v %v, pong expected", i, m, err)
+			}
+		}(i, cli)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	// idle connections go back to event loop
+	waitParked(t, s, clients)
+
+	for _, cli := range clis {
+		if err := cli.CloseGraceful(STATUS_OK, "done"); err != nil {
+			t.Error(err)
+		}
+	}
+	waitFinished(t, s)
+}
+
+func TestEventLoopKick(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer bool
+	}{
+		{"close answered", true},
+		// socket is closed by timer, parked connection is woken to finish
+		{"close timeout", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, addr := newEventServer(t, Config{CloseTimeout: 100 * time.Millisecond})
+			cli := dialTest(t, addr, Config{})
+			waitParked(t, s, 1)
+			var id uint64
+			s.Range(func(wsc *Connection) bool {
+				id = wsc.ID()
+				return false
+			})
+			if err := s.Kick(id, STATUS_POLICY, "kicked"); err != nil {
+				t.Fatal(err)
+			}
+			if tt.answer {
+				// close is echoed by Recv
+				_, err := cli.Recv()
+				var ce *CloseError
+				if !errors.As(err, &ce) || ce.Code != STATUS_POLICY || ce.Reason != "kicked" {
+					t.Fatalf("err = %v, close %d expected", err, STATUS_POLICY)
+				}
+			}
+			waitFinished(t, s)
+			if err := s.Kick(id, STATUS_POLICY, "kicked"); err != ErrUnknownConnection {
+				t.Errorf("err = %v, %v expected", err, ErrUnknownConnection)
+			}
+		})
+	}
+}
+
+func TestEventLoopShutdown(t *testing.T) {
+	const clients = 4
+	s, addr := newEventServer(t, Config{CloseTimeout: time.Second})
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		cli := dialTest(t, addr, Config{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cli.Recv()
+			var ce *CloseError
+			if !errors.As(err, &ce) || ce.Code != STATUS_GOAWAY {
+				t.Errorf("err = %v, close %d expected", err, STATUS_GOAWAY)
+			}
+		}()
+	}
+	waitParked(t, s, clients)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	waitFinished(t, s)
+
+	// poller fds are released, a new pipe may reuse them and must not be written by the second stop
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	r.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := r.Read(make([]byte, 1)); n != 0 || !os.IsTimeout(err) {
+		t.Errorf("read %d bytes from pipe, err = %v", n, err)
+	}
+}
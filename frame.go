@@ -2,52 +2,108 @@ package websocket
 
 import (
 	"bufio"
+	"crypto/rand"
 	"fmt"
-	"io"
 )
 
 type Frame struct {
-	Fin    bool
-	Opcode uint8
-	Mask   bool
-	Key    [4]byte
-	Len    int
-	r      *bufio.Reader
-	w      *bufio.Writer
-	stats  *Stats
-	done   int
+	Fin     bool
+	Rsv1    bool
+	Opcode  uint8
+	Mask    bool
+	Key     [4]byte
+	Len     int
+	r       *bufio.Reader
+	w       *bufio.Writer
+	shard   *statsShard
+	ka      *keepalive
+	limiter *rateLimiter
+	client  bool
+	deflate bool
+	done    int
 }
 
 func (f *Frame) String() string {
-	return fmt.Sprintf("Frame{ Opcode: %d, Fin: %v, Len: %d, done: %d, Mask: %v, Key: [% x] }", f.Opcode, f.Fin, f.Len, f.done, f.Mask, f.Key)
+	return fmt.Sprintf("Frame{ Opcode: %d, Fin: %v, Rsv1: %v, Len: %d, done: %d, Mask: %v, Key: [% x] }", f.Opcode, f.Fin, f.Rsv1, f.Len, f.done, f.Mask, f.Key)
 }
 
-func newFrame(wsc *Connection) *Frame {
-	return &Frame{
-		r:     wsc.r,
-		w:     wsc.w,
-		stats: wsc.server.Stats,
+// frames are values, so that they stay on the stack
+func newFrame(wsc *Connection) Frame {
+	return Frame{
+		shard:   wsc.shard,
+		ka:      wsc.ka,
+		limiter: wsc.limiter,
+		client:  wsc.client,
+		deflate: wsc.deflate != nil,
+		Mask:    wsc.client,
 	}
 }
 
+// buffers are taken from the pool only while a frame is read or sent,
+// so they are touched with rmu or wmu held
+
+func newReadFrame(wsc *Connection) Frame {
+	f := newFrame(wsc)
+	f.r = wsc.r
+	return f
+}
+
+func newWriteFrame(wsc *Connection) Frame {
+	f := newFrame(wsc)
+	f.w = wsc.w
+	return f
+}
+
+// next returns n header bytes straight from the read buffer
+func (f *Frame) next(n int) ([]byte, error) {
+	b, err := f.r.Peek(n)
+	if err != nil {
+		return nil, err
+	}
+	f.r.Discard(n)
+	return b, nil
+}
+
 func (f *Frame) readHeader() error {
-	var b [8]byte
-	if _, err := io.ReadFull(f.r, b[0:2]); err != nil {
+	b, err := f.next(2)
+	if err != nil {
 		return err
 	}
 	f.Fin = (b[0] & 0x80) > 0
+	f.Rsv1 = (b[0] & 0x40) > 0
 	f.Opcode = b[0] & 0x0f
+	if _, ok := OpcodeNames[f.Opcode]; !ok {
+		return ErrUnknownOpcode
+	}
+	// RSV1 marks compressed message, allowed only in first frame of data message
+	if f.Rsv1 && (!f.deflate || (f.Opcode != OPCODE_TEXT && f.Opcode != OPCODE_BINARY)) {
+		return ErrReservedBits
+	}
+	if b[0]&0x30 != 0 {
+		return ErrReservedBits
+	}
 	f.Mask = (b[1] & 0x80) > 0
 	f.Len = int(b[1]) & 0x7f
+	if f.Opcode >= OPCODE_CLOSE {
+		if !f.Fin {
+			return ErrFragmentedControl
+		}
+		if f.Len > MaxControlFrameLength {
+			return ErrControlTooLong
+		}
+	}
 	if f.Len == 126 {
-		if _, err := io.ReadFull(f.r, b[0:2]); err != nil {
+		if b, err = f.next(2); err != nil {
 			return err
 		}
 		f.Len = 0
 		f.Len += int(b[0]) << 8
 		f.Len += int(b[1])
+		if f.Len < 126 {
+			return ErrNonMinimalLength
+		}
 	} else if f.Len == 127 {
-		if _, err := io.ReadFull(f.r, b[:]); err != nil {
+		if b, err = f.next(8); err != nil {
 			return err
 		}
 		f.Len = 0
@@ -59,26 +115,63 @@ func (f *Frame) readHeader() error {
 		f.Len += int(b[5]) << 16
 		f.Len += int(b[6]) << 8
 		f.Len += int(b[7])
-		if f.Len < 0 {
+		if b[0]&0x80 != 0 || f.Len < 0 {
 			return ErrBadFrame
 		}
+		if f.Len <= 0xFFFF {
+			return ErrNonMinimalLength
+		}
 	}
+	// client frames are masked, server frames are not
 	if f.Mask {
-		if _, err := io.ReadFull(f.r, f.Key[:]); err != nil {
+		if f.client {
+			return ErrMaskedFrame
+		}
+		if b, err = f.next(4); err != nil {
 			return err
 		}
-	} else {
+		copy(f.Key[:], b)
+	} else if !f.client {
 		return ErrUnmaskedFrame
 	}
-	f.stats.add(eventInFrame{opcode: f.Opcode})
+	if f.ka != nil {
+		f.ka.received(f.Opcode)
+	}
+	f.shard.inFrame(f.Opcode)
+	if f.limiter != nil {
+		return f.limiter.received(f.Opcode, f.Len)
+	}
 	return nil
 }
 
 func (f *Frame) writeHeader() error {
-	b := make([]byte, 10)
+	var hdr [14]byte
+	b := f.encodeHeader(&hdr)
+	if f.Mask {
+		var err error
+		if b, err = f.maskHeader(b); err != nil {
+			return err
+		}
+	}
+	// byte by byte, so that header stays on the stack
+	for _, c := range b {
+		if err := f.w.WriteByte(c); err != nil {
+			return err
+		}
+	}
+	f.shard.outFrame(f.Opcode)
+	return nil
+}
+
+// encodeHeader puts header without masking key into hdr
+func (f *Frame) encodeHeader(hdr *[14]byte) []byte {
+	b := hdr[:]
 	if f.Fin {
 		b[0] |= 0x80
 	}
+	if f.Rsv1 {
+		b[0] |= 0x40
+	}
 	b[0] |= (f.Opcode & 0x0f)
 	if f.Len < 126 {
 		b[1] = byte(f.Len & 0x7f)
@@ -98,16 +191,21 @@ func (f *Frame) writeHeader() error {
 		b[7] = byte((f.Len >> 16) & 0xFF)
 		b[8] = byte((f.Len >> 8) & 0xFF)
 		b[9] = byte(f.Len & 0xFF)
+		b = b[0:10]
 	}
-	for len(b) > 0 {
-		n, err := f.w.Write(b)
-		if err != nil {
-			return err
-		}
-		b = b[n:]
+	return b
+}
+
+// maskHeader generates masking key and appends it to header b
+func (f *Frame) maskHeader(b []byte) ([]byte, error) {
+	// local key, so that the frame itself does not escape to crypto/rand
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
 	}
-	f.stats.add(eventOutFrame{opcode: f.Opcode})
-	return nil
+	f.Key = key
+	b[1] |= 0x80
+	return append(b, key[:]...), nil
 }
 
 func (f *Frame) read(b []byte) (int, error) {
@@ -129,23 +227,63 @@ func (f *Frame) write(b []byte) (int, error) {
 	if len(b) > f.Len-f.done {
 		panic(fmt.Sprintf("writing more than fame len. f.Len=%d f.done=%d len(b)=%d", f.done, f.Len, len(b)))
 	}
-	n, err := f.w.Write(b)
-	f.done += n
-	return n, err
+	if !f.Mask {
+		n, err := f.w.Write(b)
+		f.done += n
+		return n, err
+	}
+	// mask right into free space of write buffer to keep caller's data intact
+	total := 0
+	for len(b) > 0 {
+		buf := f.w.AvailableBuffer()
+		if cap(buf) == 0 {
+			if err := f.w.Flush(); err != nil {
+				return total, err
+			}
+			continue
+		}
+		l := len(b)
+		if l > cap(buf) {
+			l = cap(buf)
+		}
+		buf = buf[:l]
+		for i := 0; i < l; i++ {
+			buf[i] = b[i] ^ f.Key[(f.done+i)%4]
+		}
+		n, err := f.w.Write(buf)
+		f.done += n
+		total += n
+		if err != nil {
+			return total, err
+		}
+		b = b[l:]
+	}
+	return total, nil
 }
 
+// recv reads payload into pooled buffer
 func (f *Frame) recv() ([]byte, error) {
 	if f.Len == 0 {
 		return []byte{}, nil
 	}
-	b := make([]byte, f.Len)
-	for f.done < f.Len {
-		_, err := f.read(b[f.done:])
+	b := getBuffer(f.Len)
+	if err := f.readFull(b); err != nil {
+		putBuffer(b)
+		return nil, err
+	}
+	return b, nil
+}
+
+// readFull reads the rest of payload into b
+func (f *Frame) readFull(b []byte) error {
+	for n := 0; n < len(b); {
+		k, err := f.read(b[n:])
+		n += k
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
-	return b, nil
+	return nil
 }
 
 func (f *Frame) send(b []byte) error {
@@ -0,0 +1,94 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestReadHeader(t *testing.T) {
+	mask := []byte{1, 2, 3, 4}
+	header := func(b ...byte) []byte {
+		return b
+	}
+	masked := func(b ...byte) []byte {
+		b[1] |= 0x80
+		return append(b, mask...)
+	}
+	tests := []struct {
+		name    string
+		header  []byte
+		client  bool
+		deflate bool
+		len     int
+		err     error
+	}{
+		{"text", masked(0x81, 5), false, false, 5, nil},
+		{"client text", header(0x81, 5), true, false, 5, nil},
+		{"compressed text", masked(0xc1, 5), false, true, 5, nil},
+		{"compressed binary", masked(0xc2, 5), false, true, 5, nil},
+		{"continuation", masked(0x00, 5), false, false, 5, nil},
+		{"16 bit length", masked(0x82, 126, 0x00, 126), false, false, 126, nil},
+		{"64 bit length", masked(0x82, 127, 0, 0, 0, 0, 0, 1, 0x00, 0x00), false, false, 0x10000, nil},
+		{"longest ping", masked(0x89, 125), false, false, 125, nil},
+		{"empty close", masked(0x88, 0), false, false, 0, nil},
+
+		{"unknown data opcode", masked(0x83, 0), false, false, 0, ErrUnknownOpcode},
+		{"unknown control opcode", masked(0x8b, 0), false, false, 0, ErrUnknownOpcode},
+		{"rsv1 without deflate", masked(0xc1, 5), false, false, 0, ErrReservedBits},
+		{"rsv1 on continuation", masked(0x40, 5), false, true, 0, ErrReservedBits},
+		{"rsv1 on ping", masked(0xc9, 5), false, true, 0, ErrReservedBits},
+		{"rsv2", masked(0xa1, 5), false, true, 0, ErrReservedBits},
+		{"rsv3", masked(0x91, 5), false, true, 0, ErrReservedBits},
+		{"fragmented ping", masked(0x09, 5), false, false, 0, ErrFragmentedControl},
+		{"fragmented close", masked(0x08, 2), false, false, 0, ErrFragmentedControl},
+		{"long ping", masked(0x89, 126, 0x00, 126), false, false, 0, ErrControlTooLong},
+		{"long close", masked(0x88, 127, 0, 0, 0, 0, 0, 1, 0x00, 0x00), false, false, 0, ErrControlTooLong},
+		{"non minimal 16 bit length", masked(0x82, 126, 0x00, 125), false, false, 0, ErrNonMinimalLength},
+		{"non minimal 64 bit length", masked(0x82, 127, 0, 0, 0, 0, 0, 0, 0xff, 0xff), false, false, 0, ErrNonMinimalLength},
+		{"64 bit length overflow", masked(0x82, 127, 0x80, 0, 0, 0, 0, 1, 0, 0), false, false, 0, ErrBadFrame},
+		{"unmasked client frame", header(0x81, 5), false, false, 0, ErrUnmaskedFrame},
+		{"masked server frame", masked(0x81, 5), true, false, 0, ErrMaskedFrame},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := Frame{
+				r:       bufio.NewReader(bytes.NewReader(tt.header)),
+				shard:   &statsShard{},
+				client:  tt.client,
+				deflate: tt.deflate,
+			}
+			err := f.readHeader()
+			if err != tt.err {
+				t.Fatalf("err = %v, %v expected", err, tt.err)
+			}
+			if err != nil {
+				// every rejection closes connection with protocol error
+				code, reason := Err2CodeReason(err)
+				if code != STATUS_PROTOCOL_ERROR || reason != err.Error() {
+					t.Errorf("close %d %q, %d %q expected", code, reason, STATUS_PROTOCOL_ERROR, err.Error())
+				}
+				return
+			}
+			if f.Len != tt.len {
+				t.Errorf("len %d, %d expected", f.Len, tt.len)
+			}
+			if f.r.Buffered() != 0 {
+				t.Errorf("%d header bytes left", f.r.Buffered())
+			}
+			if f.shard.inFrames[f.Opcode] != 1 {
+				t.Errorf("frame is not counted")
+			}
+		})
+	}
+}
+
+func TestReadHeaderTruncated(t *testing.T) {
+	full := []byte{0x82, 0x80 | 127, 0, 0, 0, 0, 0, 1, 0, 0, 1, 2, 3, 4}
+	for i := 0; i < len(full); i++ {
+		f := Frame{r: bufio.NewReader(bytes.NewReader(full[:i])), shard: &statsShard{}}
+		if err := f.readHeader(); err == nil {
+			t.Errorf("header of %d bytes is accepted", i)
+		}
+	}
+}
@@ -1,3 +1,3 @@
 module github.com/ex0hunt/go-light-websocket
 
-go 1.18
+go 1.21
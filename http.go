@@ -40,7 +40,7 @@ func (hrw *httpResponseWriter) Write(b []byte) (int, error) {
 	return hrw.body.Write(b)
 }
 
-func (hrw *httpResponseWriter) WriteTo(w io.Writer) error {
+func (hrw *httpResponseWriter) WriteResponse(w io.Writer) error {
 	hrw.rsp.ContentLength = int64(hrw.body.Len())
 	return hrw.rsp.Write(w)
 }
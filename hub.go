@@ -0,0 +1,239 @@
+package websocket
+
+import (
+	"sync"
+)
+
+// SlowConsumerPolicy tells Hub what to do when subscriber queue is full
+type SlowConsumerPolicy uint8
+
+const (
+	DropOldest SlowConsumerPolicy = iota // forget the oldest queued message
+	DropNewest                           // forget the published message
+	Disconnect                           // close connection with STATUS_POLICY
+)
+
+type HubConfig struct {
+	QueueLen int // messages queued per subscriber, DefaultHubQueueLen by default
+	Policy   SlowConsumerPolicy
+}
+
+// Hub delivers published messages to connections subscribed to the topic.
+// Every subscriber has its own bounded queue, so a slow one does not hold the others.
+// Messages are sent by a goroutine started while the queue is not empty,
+// closed connections are unsubscribed automatically.
+type Hub struct {
+	config HubConfig
+	mu     sync.RWMutex
+	topics map[string]map[*subscriber]struct{}
+	subs   map[*Connection]*subscriber
+}
+
+type subscriber struct {
+	hub     *Hub
+	wsc     *Connection
+	topics  map[string]struct{} // guarded by hub.mu
+	mu      sync.Mutex
+	queue   []*PreparedMessage // ring, allocated with the first message
+	head    int
+	n       int
+	sending bool // flush goroutine is running
+	closed  bool
+}
+
+func NewHub(config HubConfig) *Hub {
+	if config.QueueLen <= 0 {
+		config.QueueLen = DefaultHubQueueLen
+	}
+	return &Hub{
+		config: config,
+		topics: make(map[string]map[*subscriber]struct{}),
+		subs:   make(map[*Connection]*subscriber),
+	}
+}
+
+// Subscribe adds connection to topics
+func (h *Hub) Subscribe(wsc *Connection, topics ...string) {
+	h.mu.Lock()
+	s, ok := h.subs[wsc]
+	if !ok {
+		s = &subscriber{hub: h, wsc: wsc, topics: make(map[string]struct{})}
+		h.subs[wsc] = s
+	}
+	for _, topic := range topics {
+		subs := h.topics[topic]
+		if subs == nil {
+			subs = make(map[*subscriber]struct{})
+			h.topics[topic] = subs
+		}
+		subs[s] = struct{}{}
+		s.topics[topic] = struct{}{}
+	}
+	h.mu.Unlock()
+	if !ok {
+		wsc.onClose(func() { h.remove(s) })
+	}
+}
+
+// Unsubscribe removes connection from topics, messages already queued are still sent
+func (h *Hub) Unsubscribe(wsc *Connection, topics ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.subs[wsc]
+	if s == nil {
+		return
+	}
+	for _, topic := range topics {
+		h.leave(s, topic)
+	}
+}
+
+// UnsubscribeAll removes connection from all its topics
+func (h *Hub) UnsubscribeAll(wsc *Connection) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s := h.subs[wsc]; s != nil {
+		for topic := range s.topics {
+			h.leave(s, topic)
+		}
+	}
+}
+
+// leave is called with mu held
+func (h *Hub) leave(s *subscriber, topic string) {
+	delete(s.topics, topic)
+	if subs := h.topics[topic]; subs != nil {
+		delete(subs, s)
+		if len(subs) == 0 {
+			delete(h.topics, topic)
+		}
+	}
+}
+
+// remove forgets subscriber of closed connection and drops its queue
+func (h *Hub) remove(s *subscriber) {
+	h.mu.Lock()
+	if h.subs[s.wsc] == s {
+		for topic := range s.topics {
+			h.leave(s, topic)
+		}
+		delete(h.subs, s.wsc)
+	}
+	h.mu.Unlock()
+	s.mu.Lock()
+	s.close()
+	s.mu.Unlock()
+}
+
+// Publish queues msg to all subscribers of topic and returns their number.
+// Frame is encoded once for all of them, so msg must not be modified or released after.
+func (h *Hub) Publish(topic string, msg *Message) int {
+	return h.PublishPrepared(topic, NewPreparedMessage(msg.Opcode, msg.Body))
+}
+
+// PublishPrepared queues prepared message to all subscribers of topic and returns their number
+func (h *Hub) PublishPrepared(topic string, pm *PreparedMessage) int {
+	var slow []*subscriber
+	h.mu.RLock()
+	n := len(h.topics[topic])
+	for s := range h.topics[topic] {
+		if !s.push(pm) {
+			slow = append(slow, s)
+		}
+	}
+	h.mu.RUnlock()
+	for _, s := range slow {
+		h.remove(s)
+		s.wsc.LogInfo("hub: slow consumer, disconnecting")
+		go s.wsc.kick(STATUS_POLICY, "slow consumer")
+	}
+	return n
+}
+
+// Subscribers returns number of connections subscribed to topic
+func (h *Hub) Subscribers(topic string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.topics[topic])
+}
+
+// Wrap subscribes connection to topics and runs handler, it fits raw handlers
+// and WrapChannelHandler ones: hub.Wrap(WrapChannelHandler(h, 16), "news")
+func (h *Hub) Wrap(handler HandlerFunc, topics ...string) HandlerFunc {
+	return func(wsc *Connection) error {
+		h.Subscribe(wsc, topics...)
+		return handler(wsc)
+	}
+}
+
+// push queues message, returns false if slow subscriber has to be disconnected
+func (s *subscriber) push(pm *PreparedMessage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return true
+	}
+	if s.queue == nil {
+		s.queue = make([]*PreparedMessage, s.hub.config.QueueLen)
+	}
+	if s.n == len(s.queue) {
+		switch s.hub.config.Policy {
+		case DropOldest:
+			s.pop()
+			s.wsc.LogDebug("hub: queue is full, the oldest message dropped")
+		case DropNewest:
+			s.wsc.LogDebug("hub: queue is full, message dropped")
+			return true
+		default:
+			s.close()
+			return false
+		}
+	}
+	s.queue[(s.head+s.n)%len(s.queue)] = pm
+	s.n++
+	if !s.sending {
+		s.sending = true
+		go s.flush()
+	}
+	return true
+}
+
+// pop is called with mu held
+func (s *subscriber) pop() *PreparedMessage {
+	pm := s.queue[s.head]
+	s.queue[s.head] = nil
+	s.head = (s.head + 1) % len(s.queue)
+	s.n--
+	return pm
+}
+
+// close is called with mu held, flush goroutine stops by itself
+func (s *subscriber) close() {
+	s.closed = true
+	s.queue = nil
+	s.head = 0
+	s.n = 0
+}
+
+func (s *subscriber) flush() {
+	for {
+		s.mu.Lock()
+		if s.n == 0 || s.closed {
+			s.sending = false
+			s.mu.Unlock()
+			return
+		}
+		pm := s.pop()
+		s.mu.Unlock()
+		if err := s.wsc.SendPrepared(pm); err != nil {
+			if err != ErrConnectionClosed {
+				s.wsc.LogDebug("hub: %s", err)
+			}
+			s.hub.remove(s)
+			s.mu.Lock()
+			s.sending = false
+			s.mu.Unlock()
+			return
+		}
+	}
+}
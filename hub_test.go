@@ -0,0 +1,159 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// recvTexts receives n text messages
+func recvTexts(t *testing.T, cli *Connection, n int) []string {
+	t.Helper()
+	var texts []string
+	for i := 0; i < n; i++ {
+		m, err := cli.Recv()
+		if err != nil {
+			t.Fatalf("message %d: %s", i, err)
+		}
+		if m.Opcode != OPCODE_TEXT {
+			t.Fatalf("message %d: got %s, text expected", i, m)
+		}
+		texts = append(texts, string(m.Body))
+		m.Release()
+	}
+	return texts
+}
+
+// queued returns number of messages waiting in the queue of subscriber
+func queued(h *Hub, wsc *Connection) int {
+	h.mu.RLock()
+	s := h.subs[wsc]
+	h.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n
+}
+
+func TestHubFanOut(t *testing.T) {
+	h := NewHub(HubConfig{})
+	var clis []*Connection
+	for i := 0; i < 3; i++ {
+		srv, cli := newTestPair(t, Config{})
+		h.Subscribe(srv, "news", "sport")
+		clis = append(clis, cli)
+	}
+	srv, other := newTestPair(t, Config{})
+	h.Subscribe(srv, "weather")
+
+	for i := 0; i < 5; i++ {
+		if n := h.Publish("news", &Message{OPCODE_TEXT, []byte(strconv.Itoa(i))}); n != 3 {
+			t.Fatalf("published to %d subscribers, 3 expected", n)
+		}
+	}
+	if n := h.Publish("weather", &Message{OPCODE_TEXT, []byte("sunny")}); n != 1 {
+		t.Fatalf("published to %d subscribers, 1 expected", n)
+	}
+	if n := h.Publish("nobody", &Message{OPCODE_TEXT, []byte("lost")}); n != 0 {
+		t.Fatalf("published to %d subscribers, 0 expected", n)
+	}
+	for i, cli := range clis {
+		if got := fmt.Sprint(recvTexts(t, cli, 5)); got != "[0 1 2 3 4]" {
+			t.Errorf("client %d got %s", i, got)
+		}
+	}
+	// messages of other topics are not delivered
+	if got := recvTexts(t, other, 1)[0]; got != "sunny" {
+		t.Errorf("got %q, sunny expected", got)
+	}
+
+	h.Unsubscribe(srv, "weather")
+	if n := h.Subscribers("weather"); n != 0 {
+		t.Errorf("%d subscribers after Unsubscribe", n)
+	}
+	h.UnsubscribeAll(srv)
+	h.Subscribe(srv, "news")
+	if n := h.Subscribers("news"); n != 4 {
+		t.Errorf("%d subscribers, 4 expected", n)
+	}
+}
+
+func TestHubAutoUnsubscribe(t *testing.T) {
+	h := NewHub(HubConfig{})
+	srv, _ := newTestPair(t, Config{})
+	h.Subscribe(srv, "news", "sport")
+	srv.Close()
+	if n := h.Subscribers("news") + h.Subscribers("sport"); n != 0 {
+		t.Errorf("%d subscribers of closed connection", n)
+	}
+	// closed connection is not subscribed again
+	h.Subscribe(srv, "news")
+	if n := h.Subscribers("news"); n != 0 {
+		t.Errorf("%d subscribers of closed connection", n)
+	}
+	if n := h.Publish("news", &Message{OPCODE_TEXT, []byte("lost")}); n != 0 {
+		t.Errorf("published to %d subscribers, 0 expected", n)
+	}
+}
+
+func TestHubSlowConsumer(t *testing.T) {
+	const queueLen = 4
+	const published = 10
+	tests := []struct {
+		name   string
+		policy SlowConsumerPolicy
+		texts  string // received after the first message
+	}{
+		{"drop oldest", DropOldest, "[7 8 9 10]"},
+		{"drop newest", DropNewest, "[1 2 3 4]"},
+		{"disconnect", Disconnect, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHub(HubConfig{QueueLen: queueLen, Policy: tt.policy})
+			srv, cli := newTestPair(t, Config{CloseTimeout: time.Second})
+			h.Subscribe(srv, "news")
+
+			// the first message holds the sender while the queue is overflowed
+			srv.msgMu.Lock()
+			h.Publish("news", &Message{OPCODE_TEXT, []byte("0")})
+			waitFor(t, "the first message to be taken", func() bool {
+				return queued(h, srv) == 0
+			})
+			for i := 1; i <= published; i++ {
+				h.Publish("news", &Message{OPCODE_TEXT, []byte(strconv.Itoa(i))})
+			}
+			subscribers := h.Subscribers("news")
+			srv.msgMu.Unlock()
+
+			if tt.policy == Disconnect {
+				if subscribers != 0 {
+					t.Errorf("%d subscribers after disconnect", subscribers)
+				}
+				// only the message taken before the overflow may come before close
+				m, err := cli.Recv()
+				if err == nil && string(m.Body) == "0" {
+					_, err = cli.Recv()
+				} else if err == nil {
+					t.Fatalf("got %s after disconnect", m)
+				}
+				var ce *CloseError
+				if !errors.As(err, &ce) || ce.Code != STATUS_POLICY {
+					t.Fatalf("err = %v, close %d expected", err, STATUS_POLICY)
+				}
+				return
+			}
+			if subscribers != 1 {
+				t.Errorf("%d subscribers, 1 expected", subscribers)
+			}
+			texts := recvTexts(t, cli, queueLen+1)
+			if texts[0] != "0" {
+				t.Errorf("got %q, the first message expected", texts[0])
+			}
+			if got := fmt.Sprint(texts[1:]); got != tt.texts {
+				t.Errorf("got %s, %s expected", got, tt.texts)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package websocket
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// keepalive pings quiet peers and drops dead or idle ones.
+// It is driven by a single timer per connection, so no goroutine is parked.
+type keepalive struct {
+	lastFrame int64 // unix nanos of any received frame, accessed atomically
+	lastData  int64 // unix nanos of received data frame, accessed atomically
+	pingSent  int64 // used by tick only
+	wsc       *Connection
+	mu        sync.Mutex // guards timer
+	timer     *time.Timer
+	state     uint32 // accessed atomically
+}
+
+const (
+	keepaliveRunning = iota
+	keepaliveStopped
+	keepaliveExpired
+)
+
+func (wsc *Connection) startKeepalive() {
+	if wsc.config.PingInterval <= 0 && wsc.config.IdleTimeout <= 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+	ka := &keepalive{wsc: wsc, lastFrame: now, lastData: now}
+	wsc.ka = ka
+	ka.mu.Lock()
+	ka.timer = time.AfterFunc(ka.next(now), ka.tick)
+	ka.mu.Unlock()
+}
+
+func (ka *keepalive) stop() {
+	if ka == nil {
+		return
+	}
+	ka.mu.Lock()
+	atomic.CompareAndSwapUint32(&ka.state, keepaliveRunning, keepaliveStopped)
+	if ka.timer != nil {
+		ka.timer.Stop()
+	}
+	ka.mu.Unlock()
+}
+
+// received is called for every frame header read from the peer
+func (ka *keepalive) received(opcode uint8) {
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&ka.lastFrame, now)
+	if opcode < OPCODE_CLOSE {
+		atomic.StoreInt64(&ka.lastData, now)
+	}
+}
+
+func (ka *keepalive) waitingPong() bool {
+	return ka.pingSent != 0 && atomic.LoadInt64(&ka.lastFrame) < ka.pingSent
+}
+
+// next returns delay till the next check
+func (ka *keepalive) next(now int64) time.Duration {
+	config := ka.wsc.config
+	due := int64(-1)
+	if ka.waitingPong() {
+		due = ka.pingSent + int64(config.PongTimeout)
+	} else if config.PingInterval > 0 {
+		due = atomic.LoadInt64(&ka.lastFrame) + int64(config.PingInterval)
+	}
+	if config.IdleTimeout > 0 {
+		idle := atomic.LoadInt64(&ka.lastData) + int64(config.IdleTimeout)
+		if due < 0 || idle < due {
+			due = idle
+		}
+	}
+	return time.Duration(due - now)
+}
+
+func (ka *keepalive) tick() {
+	switch atomic.LoadUint32(&ka.state) {
+	case keepaliveStopped:
+		return
+	case keepaliveExpired:
+		// no answer to idle close, parked connection must see the deadline
+		ka.wsc.wake()
+		return
+	}
+	config := ka.wsc.config
+	now := time.Now().UnixNano()
+	if config.IdleTimeout > 0 && now-atomic.LoadInt64(&ka.lastData) >= int64(config.IdleTimeout) {
+		ka.expire(false)
+		return
+	}
+	if ka.waitingPong() {
+		if now-ka.pingSent >= int64(config.PongTimeout) {
+			ka.expire(true)
+			return
+		}
+	} else if config.PingInterval > 0 && now-atomic.LoadInt64(&ka.lastFrame) >= int64(config.PingInterval) {
+		if err := ka.wsc.SendPing(nil); err != nil {
+			ka.wsc.LogDebug("keepalive ping failed: %s", err)
+		}
+		// even if ping failed, the peer must show up within PongTimeout
+		ka.pingSent = now
+	}
+	ka.mu.Lock()
+	if atomic.LoadUint32(&ka.state) == keepaliveRunning {
+		ka.timer.Reset(ka.next(now))
+	}
+	ka.mu.Unlock()
+}
+
+// expire breaks pending reads, so the handler gets ErrPeerTimeout.
+// Dead peer is dropped without closing handshake (1006),
+// idle one is asked to go away (1001) and given CloseTimeout to answer.
+func (ka *keepalive) expire(dead bool) {
+	if !atomic.CompareAndSwapUint32(&ka.state, keepaliveRunning, keepaliveExpired) {
+		return
+	}
+	wsc := ka.wsc
+	wsc.stats.peerTimeout()
+	if dead {
+		wsc.LogInfo("no pong within %s, dropping connection", wsc.config.PongTimeout)
+		wsc.SetReadDeadline(aLongTimeAgo)
+		wsc.SetWriteDeadline(aLongTimeAgo)
+		wsc.wake()
+		return
+	}
+	wsc.LogInfo("idle for %s, closing connection", wsc.config.IdleTimeout)
+	wsc.SendClose(STATUS_GOAWAY, "idle timeout")
+	wsc.SetReadDeadlineDuration(wsc.config.CloseTimeout)
+	ka.mu.Lock()
+	ka.timer.Reset(wsc.config.CloseTimeout)
+	ka.mu.Unlock()
+}
+
+// ioError replaces deadline errors caused by expired keepalive
+func (ka *keepalive) ioError(err error) error {
+	if ka != nil && atomic.LoadUint32(&ka.state) == keepaliveExpired && errors.Is(err, os.ErrDeadlineExceeded) {
+		return ErrPeerTimeout
+	}
+	return err
+}
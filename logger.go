@@ -0,0 +1,83 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// Logger receives logs of server and connections. Level is one of LOG_ERROR..LOG_DEBUG,
+// keyvals are alternating keys and values, e.g. "remote", "10.0.0.1:5678".
+// It is called from many goroutines concurrently.
+type Logger interface {
+	Log(level uint8, msg string, keyvals ...interface{})
+}
+
+// StdLogger writes to the standard log package, it is used by default
+type StdLogger struct{}
+
+func (StdLogger) Log(level uint8, msg string, keyvals ...interface{}) {
+	var b strings.Builder
+	b.WriteString(logNames[level])
+	b.WriteString(": ")
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 < len(keyvals) {
+			fmt.Fprintf(&b, " %v=%v", keyvals[i], keyvals[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v", keyvals[i])
+		}
+	}
+	log.Println(b.String())
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+var slogLevels = map[uint8]slog.Level{
+	LOG_ERROR: slog.LevelError,
+	LOG_WARN:  slog.LevelWarn,
+	LOG_INFO:  slog.LevelInfo,
+	LOG_DEBUG: slog.LevelDebug,
+}
+
+// NewSlogLogger passes logs to l (slog.Default() if nil), levels are mapped to slog ones
+func NewSlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return slogLogger{l}
+}
+
+func (s slogLogger) Log(level uint8, msg string, keyvals ...interface{}) {
+	s.l.Log(context.Background(), slogLevels[level], msg, keyvals...)
+}
+
+func (s slogLogger) with(keyvals ...interface{}) Logger {
+	return slogLogger{s.l.With(keyvals...)}
+}
+
+type fieldsLogger struct {
+	l      Logger
+	fields []interface{}
+}
+
+func (f *fieldsLogger) Log(level uint8, msg string, keyvals ...interface{}) {
+	f.l.Log(level, msg, append(f.fields[:len(f.fields):len(f.fields)], keyvals...)...)
+}
+
+func (f *fieldsLogger) with(keyvals ...interface{}) Logger {
+	return &fieldsLogger{f.l, append(f.fields[:len(f.fields):len(f.fields)], keyvals...)}
+}
+
+// LoggerWith returns logger which adds keyvals to every record,
+// e.g. wsc.SetLogger(LoggerWith(wsc.Logger(), "path", req.URL.Path)) in HandshakeFunc
+func LoggerWith(l Logger, keyvals ...interface{}) Logger {
+	if w, ok := l.(interface{ with(...interface{}) Logger }); ok {
+		return w.with(keyvals...)
+	}
+	return &fieldsLogger{l, keyvals}
+}
@@ -1,7 +1,9 @@
 package websocket
 
 import (
+	"errors"
 	"fmt"
+	"unicode/utf8"
 )
 
 // simple message
@@ -30,6 +32,18 @@ func (m Message) String() string {
 	return fmt.Sprintf(name+":"+format+cont, body)
 }
 
+// Release returns message to the pool, neither message nor its Body may be used after.
+// It is optional: messages which are not released are garbage collected as usual.
+// Close messages are never reused, since they are kept in RcvdClose/SentClose.
+func (m *Message) Release() {
+	if m.Opcode == OPCODE_CLOSE {
+		return
+	}
+	putBuffer(m.Body)
+	m.Body = nil
+	messagePool.Put(m)
+}
+
 func (m Message) Error() string {
 	if name, ok := OpcodeNames[m.Opcode]; ok {
 		return "<" + name + "> message"
@@ -50,21 +64,121 @@ func ParseCloseBody(b []byte) (code uint16, reason string) {
 	return
 }
 
+// CloseError is returned by read methods when close frame is received, the frame is echoed
+// internally. Remote reports whether the peer started closing handshake, otherwise the frame
+// answers ours. Err2CodeReason turns it back into code and reason.
+type CloseError struct {
+	Code   uint16
+	Reason string
+	Remote bool
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("close %d", e.Code)
+	}
+	return fmt.Sprintf("close %d: %s", e.Code, e.Reason)
+}
+
+// Is matches CloseError with the same code, e.g. errors.Is(err, &CloseError{Code: STATUS_GOAWAY})
+func (e *CloseError) Is(target error) bool {
+	t, ok := target.(*CloseError)
+	return ok && t.Code == e.Code
+}
+
+func newCloseError(body []byte, remote bool) *CloseError {
+	code, reason := ParseCloseBody(body)
+	return &CloseError{Code: code, Reason: reason, Remote: remote}
+}
+
+// validCloseCode reports whether code may be sent in close frame
+func validCloseCode(code uint16) bool {
+	switch {
+	case code >= STATUS_OK && code <= STATUS_UNACCEPTABLE_DATA:
+		return true
+	case code >= STATUS_BAD_DATA && code <= STATUS_INTERNAL:
+		return true
+	case code >= 1012 && code <= 1014: // registered by IANA
+		return true
+	case code >= 3000 && code <= 4999: // libraries, frameworks and applications
+		return true
+	}
+	return false
+}
+
+func validateCloseBody(b []byte, checkUTF8 bool) error {
+	if len(b) == 1 {
+		return ErrBadCloseBody
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	code, reason := ParseCloseBody(b)
+	if !validCloseCode(code) {
+		return ErrBadCloseCode
+	}
+	if checkUTF8 && !utf8.ValidString(reason) {
+		return ErrInvalidUTF8
+	}
+	return nil
+}
+
+// errors sent to the peer with their own close codes
+var errorCodes = []struct {
+	err  error
+	code uint16
+}{
+	{ErrBadFrame, STATUS_PROTOCOL_ERROR},
+	{ErrUnmaskedFrame, STATUS_PROTOCOL_ERROR},
+	{ErrMaskedFrame, STATUS_PROTOCOL_ERROR},
+	{ErrUnexpectedFrame, STATUS_PROTOCOL_ERROR},
+	{ErrUnexpectedContinuation, STATUS_PROTOCOL_ERROR},
+	{ErrUnknownOpcode, STATUS_PROTOCOL_ERROR},
+	{ErrReservedBits, STATUS_PROTOCOL_ERROR},
+	{ErrFragmentedControl, STATUS_PROTOCOL_ERROR},
+	{ErrControlTooLong, STATUS_PROTOCOL_ERROR},
+	{ErrNonMinimalLength, STATUS_PROTOCOL_ERROR},
+	{ErrBadCloseBody, STATUS_PROTOCOL_ERROR},
+	{ErrBadCloseCode, STATUS_PROTOCOL_ERROR},
+	{ErrPeerTimeout, STATUS_GOAWAY},
+	{ErrMessageTooLarge, STATUS_TOO_LARGE},
+	{ErrBadCompression, STATUS_BAD_DATA},
+	{ErrInvalidUTF8, STATUS_BAD_DATA},
+	{ErrRateLimited, STATUS_POLICY},
+}
+
+// Err2CodeReason returns close code and reason for error, wrapped errors are recognized too.
+// Reason of wrapped error is the message of the known one, so it fits into close frame.
 func Err2CodeReason(err error) (uint16, string) {
 	if err == nil {
 		return STATUS_OK, ""
 	}
-	switch err {
-	case ErrBadFrame, ErrUnmaskedFrame, ErrUnexpectedFrame, ErrUnexpectedContinuation:
-		return STATUS_PROTOCOL_ERROR, err.Error()
-	case ErrUnknownOpcode:
-		return STATUS_UNACCEPTABLE_DATA, err.Error()
-	case ErrMessageTooLarge:
-		return STATUS_TOO_LARGE, err.Error()
-	default:
-		return STATUS_INTERNAL, "internal"
+	var ce *CloseError
+	if errors.As(err, &ce) {
+		if !validCloseCode(ce.Code) {
+			return STATUS_OK, ""
+		}
+		return ce.Code, truncateReason(ce.Reason)
+	}
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code, ec.err.Error()
+		}
+	}
+	return STATUS_INTERNAL, "internal"
+}
+
+// truncateReason cuts reason to fit into control frame keeping utf-8 valid
+func truncateReason(reason string) string {
+	const maxLen = MaxControlFrameLength - 2
+	if len(reason) <= maxLen {
+		return reason
+	}
+	reason = reason[:maxLen]
+	for len(reason) > 0 && !utf8.ValidString(reason) {
+		reason = reason[:len(reason)-1]
 	}
-	panic("freak out")
+	return reason
 }
 
 func BuildCloseBody(code uint16, reason string) []byte {
@@ -81,28 +195,42 @@ func BuildCloseBodyError(err error) []byte {
 
 // multiframe message
 
+// fragments are assembled in one growing pooled buffer
 type MultiframeMessage struct {
-	Opcode uint8
-	Bbuf   [][]byte
+	Opcode     uint8
+	Compressed bool
+	Buf        []byte
 }
 
-func (m MultiframeMessage) Len() (total int) {
-	for _, b := range m.Bbuf {
-		total += len(b)
-	}
-	return
+func (m MultiframeMessage) Len() int {
+	return len(m.Buf)
 }
 
 func (m *MultiframeMessage) Append(b []byte) {
-	m.Bbuf = append(m.Bbuf, b)
+	n := len(m.Buf)
+	m.Buf = growBuffer(m.Buf, len(b))
+	copy(m.Buf[n:], b)
 }
 
-func (m *MultiframeMessage) AsMessage() *Message {
-	res := make([]byte, m.Len())
-	bp := 0
-	for _, b := range m.Bbuf {
-		copy(res[bp:], b)
-		bp += len(b)
+// appendFrame reads frame payload right into the message buffer
+func (m *MultiframeMessage) appendFrame(f *Frame) ([]byte, error) {
+	n := len(m.Buf)
+	m.Buf = growBuffer(m.Buf, f.Len)
+	if err := f.readFull(m.Buf[n:]); err != nil {
+		return nil, err
 	}
-	return &Message{m.Opcode, res}
+	return m.Buf[n:], nil
+}
+
+// AsMessage passes the buffer to the message
+func (m *MultiframeMessage) AsMessage() *Message {
+	msg := newMessage(m.Opcode, m.Buf)
+	m.Buf = nil
+	return msg
+}
+
+// release returns buffer of unfinished message to the pool
+func (m *MultiframeMessage) release() {
+	putBuffer(m.Buf)
+	m.Buf = nil
 }
@@ -0,0 +1,73 @@
+package websocket
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestValidateCloseBody(t *testing.T) {
+	tests := []struct {
+		body      []byte
+		checkUTF8 bool
+		err       error
+	}{
+		{[]byte{}, true, nil},
+		{BuildCloseBody(STATUS_OK, ""), true, nil},
+		{BuildCloseBody(STATUS_GOAWAY, "bye"), true, nil},
+		{BuildCloseBody(STATUS_UNACCEPTABLE_DATA, ""), true, nil},
+		{BuildCloseBody(STATUS_BAD_DATA, ""), true, nil},
+		{BuildCloseBody(STATUS_INTERNAL, ""), true, nil},
+		{BuildCloseBody(1012, ""), true, nil},
+		{BuildCloseBody(1014, ""), true, nil},
+		{BuildCloseBody(3000, ""), true, nil},
+		{BuildCloseBody(4999, "app"), true, nil},
+		{BuildCloseBody(STATUS_OK, "κόσμε"), true, nil},
+		{BuildCloseBody(STATUS_OK, "\xff"), false, nil},
+
+		{[]byte{0x03}, true, ErrBadCloseBody},
+		{BuildCloseBody(0, ""), true, ErrBadCloseCode},
+		{BuildCloseBody(999, ""), true, ErrBadCloseCode},
+		{BuildCloseBody(STATUS_RESERVED, ""), true, ErrBadCloseCode},
+		{BuildCloseBody(STATUS_NOSTATUS, ""), true, ErrBadCloseCode},
+		{BuildCloseBody(STATUS_BAD_CLOSED, ""), true, ErrBadCloseCode},
+		{BuildCloseBody(1015, ""), true, ErrBadCloseCode},
+		{BuildCloseBody(1016, ""), true, ErrBadCloseCode},
+		{BuildCloseBody(2999, ""), true, ErrBadCloseCode},
+		{BuildCloseBody(5000, ""), true, ErrBadCloseCode},
+		{BuildCloseBody(STATUS_OK, "\xff"), true, ErrInvalidUTF8},
+		{BuildCloseBody(STATUS_OK, "ab\xe2\x82"), true, ErrInvalidUTF8},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%x/%v", tt.body, tt.checkUTF8), func(t *testing.T) {
+			err := validateCloseBody(tt.body, tt.checkUTF8)
+			if err != tt.err {
+				t.Fatalf("err = %v, %v expected", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestErr2CodeReason(t *testing.T) {
+	tests := []struct {
+		err    error
+		code   uint16
+		reason string
+	}{
+		{nil, STATUS_OK, ""},
+		{ErrBadCloseBody, STATUS_PROTOCOL_ERROR, ErrBadCloseBody.Error()},
+		{ErrBadCloseCode, STATUS_PROTOCOL_ERROR, ErrBadCloseCode.Error()},
+		{ErrInvalidUTF8, STATUS_BAD_DATA, ErrInvalidUTF8.Error()},
+		{fmt.Errorf("frame 3: %w", ErrReservedBits), STATUS_PROTOCOL_ERROR, ErrReservedBits.Error()},
+		{ErrMessageTooLarge, STATUS_TOO_LARGE, ErrMessageTooLarge.Error()},
+		{&CloseError{Code: 4000, Reason: "app"}, 4000, "app"},
+		// code which must not be sent
+		{&CloseError{Code: STATUS_NOSTATUS}, STATUS_OK, ""},
+		{fmt.Errorf("unknown"), STATUS_INTERNAL, "internal"},
+	}
+	for _, tt := range tests {
+		code, reason := Err2CodeReason(tt.err)
+		if code != tt.code || reason != tt.reason {
+			t.Errorf("%v: close %d %q, %d %q expected", tt.err, code, reason, tt.code, tt.reason)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package websocket
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// metrics are written in prometheus text exposition format, no client library needed
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (mw metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (mw metricsWriter) gauge(name, help string, v uint64) {
+	mw.header(name, "gauge", help)
+	fmt.Fprintf(mw.w, "%s %d\n", name, v)
+}
+
+func (mw metricsWriter) counter(name, help string, v uint64) {
+	mw.header(name, "counter", help)
+	fmt.Fprintf(mw.w, "%s %d\n", name, v)
+}
+
+func (mw metricsWriter) frames(name, help string, counts *[maxOpcode + 1]uint64) {
+	mw.header(name, "counter", help)
+	for _, opcode := range KnownOpcodes {
+		fmt.Fprintf(mw.w, "%s{opcode=%q} %d\n", name, OpcodeNames[opcode], counts[opcode])
+	}
+}
+
+// WriteMetrics writes stats in prometheus text format, metric names start with websocket_
+func (st *Stats) WriteMetrics(w io.Writer) error {
+	ss := st.Snapshot()
+	mw := metricsWriter{bufio.NewWriter(w)}
+	mw.gauge("websocket_connections", "Number of open connections.", ss.Connections)
+	mw.gauge("websocket_connections_max", "Maximal number of open connections.", ss.MaxConnections)
+	mw.gauge("websocket_connections_reading", "Number of connections reading from socket (IOStatistics).", ss.ConnectionsReading)
+	mw.gauge("websocket_connections_writing", "Number of connections writing to socket (IOStatistics).", ss.ConnectionsWriting)
+	mw.gauge("websocket_connections_parked", "Number of connections waiting in event loop.", ss.ConnectionsParked)
+	mw.gauge("websocket_connections_active", "Number of connections served by goroutine.", ss.ConnectionsActive)
+	mw.counter("websocket_handshakes_total", "Number of successful handshakes.", ss.Handshakes)
+	mw.counter("websocket_handshakes_failed_total", "Number of failed handshakes.", ss.HandshakesFailed)
+	mw.counter("websocket_peer_timeouts_total", "Number of peers dropped by keepalive.", ss.PeerTimeouts)
+	mw.counter("websocket_rate_limit_delays_total", "Number of reads delayed by rate limit.", ss.RateLimitDelays)
+	mw.counter("websocket_rate_limit_closes_total", "Number of connections closed by rate limit.", ss.RateLimitCloses)
+	mw.frames("websocket_frames_in_total", "Number of received frames by opcode.", &ss.InFrames)
+	mw.frames("websocket_frames_out_total", "Number of sent frames by opcode.", &ss.OutFrames)
+	return mw.w.Flush()
+}
+
+// MetricsHandler serves stats to prometheus scraper, e.g. http.Handle("/metrics", server.Stats.MetricsHandler())
+func (st *Stats) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		st.WriteMetrics(w)
+	})
+}
@@ -0,0 +1,173 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type metricSample struct {
+	labels string
+	value  float64
+}
+
+type metricFamily struct {
+	help    string
+	typ     string
+	samples []metricSample
+}
+
+// parseMetrics parses text exposition format, sample must follow HELP and TYPE of its family
+func parseMetrics(text string) (map[string]*metricFamily, error) {
+	families := make(map[string]*metricFamily)
+	family := func(name string) *metricFamily {
+		if families[name] == nil {
+			families[name] = &metricFamily{}
+		}
+		return families[name]
+	}
+	sc := bufio.NewScanner(strings.NewReader(text))
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "# ") {
+			fields := strings.SplitN(line[2:], " ", 3)
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("bad comment %q", line)
+			}
+			switch fields[0] {
+			case "HELP":
+				family(fields[1]).help = fields[2]
+			case "TYPE":
+				family(fields[1]).typ = fields[2]
+			default:
+				return nil, fmt.Errorf("unknown comment %q", line)
+			}
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			return nil, fmt.Errorf("bad sample %q", line)
+		}
+		name, labels := line[:i], ""
+		if j := strings.IndexByte(name, '{'); j >= 0 {
+			if !strings.HasSuffix(name, "}") {
+				return nil, fmt.Errorf("bad labels %q", line)
+			}
+			name, labels = name[:j], name[j+1:len(name)-1]
+		}
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad value %q: %w", line, err)
+		}
+		f := families[name]
+		if f == nil || f.help == "" || f.typ == "" {
+			return nil, fmt.Errorf("sample %q before HELP and TYPE", line)
+		}
+		f.samples = append(f.samples, metricSample{labels, value})
+	}
+	return families, sc.Err()
+}
+
+func TestWriteMetrics(t *testing.T) {
+	st := newStats()
+	st.connect()
+	st.connect()
+	st.disconnect()
+	st.handshake()
+	sh := st.shard()
+	sh.inFrame(OPCODE_TEXT)
+	sh.inFrame(OPCODE_TEXT)
+	sh.outFrame(OPCODE_PING)
+
+	var buf bytes.Buffer
+	if err := st.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	families, err := parseMetrics(buf.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) == 0 {
+		t.Fatal("no metrics")
+	}
+	for name, f := range families {
+		if !strings.HasPrefix(name, "websocket_") {
+			t.Errorf("%s: websocket_ prefix expected", name)
+		}
+		if f.typ != "counter" && f.typ != "gauge" {
+			t.Errorf("%s: unexpected type %q", name, f.typ)
+		}
+		if (f.typ == "counter") != strings.HasSuffix(name, "_total") {
+			t.Errorf("%s: only counters end with _total, got %s", name, f.typ)
+		}
+		if len(f.samples) == 0 {
+			t.Errorf("%s: no samples", name)
+		}
+	}
+
+	values := map[string]float64{
+		"websocket_connections":      1,
+		"websocket_connections_max":  2,
+		"websocket_handshakes_total": 1,
+	}
+	for name, want := range values {
+		f := families[name]
+		if f == nil || len(f.samples) != 1 || f.samples[0].labels != "" {
+			t.Errorf("%s: single sample without labels expected", name)
+			continue
+		}
+		if f.samples[0].value != want {
+			t.Errorf("%s = %v, %v expected", name, f.samples[0].value, want)
+		}
+	}
+
+	frames := map[string]map[string]float64{
+		"websocket_frames_in_total":  {"text": 2},
+		"websocket_frames_out_total": {"ping": 1},
+	}
+	for name, want := range frames {
+		f := families[name]
+		if f == nil || f.typ != "counter" {
+			t.Errorf("%s: counter expected", name)
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, s := range f.samples {
+			var opcode string
+			if _, err := fmt.Sscanf(s.labels, "opcode=%q", &opcode); err != nil {
+				t.Errorf("%s: bad labels %q", name, s.labels)
+				continue
+			}
+			if seen[opcode] {
+				t.Errorf("%s: duplicate opcode %q", name, opcode)
+			}
+			seen[opcode] = true
+			if s.value != want[opcode] {
+				t.Errorf("%s{opcode=%q} = %v, %v expected", name, opcode, s.value, want[opcode])
+			}
+		}
+		for _, opcode := range OpcodeNames {
+			if !seen[opcode] {
+				t.Errorf("%s: opcode %q missed", name, opcode)
+			}
+		}
+		if len(seen) != len(OpcodeNames) {
+			t.Errorf("%s: %d opcodes, %d expected", name, len(seen), len(OpcodeNames))
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newStats().MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != metricsContentType {
+		t.Errorf("Content-Type %q, %q expected", ct, metricsContentType)
+	}
+	if _, err := parseMetrics(rec.Body.String()); err != nil {
+		t.Error(err)
+	}
+}
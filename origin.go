@@ -0,0 +1,61 @@
+package websocket
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// checkOrigin protects from cross-site websocket hijacking.
+// Requests without Origin (non-browser clients) and same host requests are allowed,
+// other origins must match Config.AllowedOrigins. Config.CheckOrigin overrides the policy.
+func (wsc *Connection) checkOrigin(req *http.Request) bool {
+	if wsc.config.CheckOrigin != nil {
+		return wsc.config.CheckOrigin(req)
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, req.Host) {
+		return true
+	}
+	for _, pattern := range wsc.config.AllowedOrigins {
+		if matchOrigin(pattern, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin matches origin against pattern like "example.com", "*.example.com",
+// "https://example.com:8443" or "*". Port is checked only if pattern has it.
+func matchOrigin(pattern string, u *url.URL) bool {
+	if pattern == "*" {
+		return true
+	}
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		if !strings.EqualFold(pattern[:i], u.Scheme) {
+			return false
+		}
+		pattern = pattern[i+3:]
+	}
+	host := u.Hostname()
+	if _, port, err := net.SplitHostPort(pattern); err == nil {
+		if port != u.Port() {
+			return false
+		}
+		pattern = pattern[:len(pattern)-len(port)-1]
+	}
+	pattern = strings.ToLower(strings.Trim(pattern, "[]"))
+	host = strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
@@ -0,0 +1,140 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchOrigin(t *testing.T) {
+	tests := []struct {
+		pattern string
+		origin  string
+		ok      bool
+	}{
+		{"*", "https://anything.net", true},
+		{"example.com", "https://example.com", true},
+		{"example.com", "http://EXAMPLE.com", true},
+		{"Example.COM", "https://example.com", true},
+		{"example.com", "https://example.com:8443", true},
+		{"example.com", "https://example.com.evil.com", false},
+		{"example.com", "https://evil.com/example.com", false},
+		{"example.com", "https://www.example.com", false},
+		{"*.example.com", "https://www.example.com", true},
+		{"*.example.com", "https://a.b.example.com:8080", true},
+		{"*.example.com", "https://evilexample.com", false},
+		{"*.example.com", "https://example.com", false},
+		{"*.example.com", "https://www.example.com.evil.com", false},
+		{"example.com:8443", "https://example.com:8443", true},
+		{"example.com:8443", "https://example.com:9443", false},
+		{"example.com:8443", "https://example.com", false},
+		{"*.example.com:8443", "https://www.example.com:8443", true},
+		{"*.example.com:8443", "https://www.example.com", false},
+		{"https://example.com", "https://example.com", true},
+		{"https://example.com", "http://example.com", false},
+		{"HTTPS://example.com", "https://example.com:8443", true},
+		{"https://example.com:8443", "https://example.com:8443", true},
+		{"https://example.com:8443", "http://example.com:8443", false},
+		{"https://*.example.com", "https://www.example.com", true},
+		{"https://*.example.com", "http://www.example.com", false},
+		{"[::1]:8080", "http://[::1]:8080", true},
+		{"[::1]", "http://[::1]:8080", true},
+		{"[::1]:8080", "http://[::1]:9090", false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%s", tt.pattern, tt.origin), func(t *testing.T) {
+			u, err := url.Parse(tt.origin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok := matchOrigin(tt.pattern, u); ok != tt.ok {
+				t.Errorf("ok = %v, %v expected", ok, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		host    string
+		origin  string
+		ok      bool
+	}{
+		{"no origin", nil, "ws.example.com", "", true},
+		{"same host", nil, "ws.example.com", "https://ws.example.com", true},
+		{"same host and port", nil, "ws.example.com:8080", "http://WS.example.com:8080", true},
+		{"same host other port", nil, "ws.example.com:8080", "http://ws.example.com", false},
+		{"other host", nil, "ws.example.com", "https://example.com", false},
+		{"null", nil, "ws.example.com", "null", false},
+		{"null allowed by any", []string{"*"}, "ws.example.com", "null", false},
+		{"bad url", []string{"*"}, "ws.example.com", "https://%zz", false},
+		{"allowed", []string{"other.net", "*.example.com"}, "ws.example.com", "https://app.example.com", true},
+		{"not allowed", []string{"other.net", "*.example.com"}, "ws.example.com", "https://evilexample.com", false},
+		{"any", []string{"*"}, "ws.example.com", "https://evil.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wsc := &Connection{config: &Config{AllowedOrigins: tt.allowed}}
+			req := &http.Request{Host: tt.host, Header: make(http.Header)}
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if ok := wsc.checkOrigin(req); ok != tt.ok {
+				t.Errorf("ok = %v, %v expected", ok, tt.ok)
+			}
+		})
+	}
+
+	// custom policy replaces the default one, including requests without origin
+	wsc := &Connection{config: &Config{
+		AllowedOrigins: []string{"*"},
+		CheckOrigin: func(req *http.Request) bool {
+			return req.Header.Get("Origin") == "https://app.example.com"
+		},
+	}}
+	for origin, ok := range map[string]bool{"https://app.example.com": true, "https://evil.com": false, "": false} {
+		req := &http.Request{Host: "ws.example.com", Header: http.Header{"Origin": {origin}}}
+		if wsc.checkOrigin(req) != ok {
+			t.Errorf("CheckOrigin: origin %q: %v expected", origin, ok)
+		}
+	}
+}
+
+func TestOriginForbidden(t *testing.T) {
+	s, addr := newTestServer(t, Config{AllowedOrigins: []string{"*.example.com"}}, func(wsc *Connection) error {
+		return nil
+	})
+	dial := func(origin string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		cli, err := Dial(ctx, "ws://"+addr, DialConfig{Header: http.Header{"Origin": {origin}}, Stats: newStats()})
+		if err == nil {
+			cli.Close()
+		}
+		return err
+	}
+	err := dial("https://evilexample.com")
+	if !errors.Is(err, ErrBadHandshake) || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("err = %v, 403 expected", err)
+	}
+	// handshakes are counted after the response is written
+	waitFor(t, "failed handshake", func() bool {
+		return s.Stats.Snapshot().HandshakesFailed == 1
+	})
+	if err := dial("https://app.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "handshake", func() bool {
+		return s.Stats.Snapshot().Handshakes == 1
+	})
+	if n := s.Stats.Snapshot().HandshakesFailed; n != 1 {
+		t.Errorf("%d failed handshakes, 1 expected", n)
+	}
+}
@@ -0,0 +1,89 @@
+//go:build linux
+
+package websocket
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// one shot level triggered events, connection is rearmed when it is parked again
+const epollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+type epoll struct {
+	fd   int
+	pipe [2]int        // written by close to stop wait, registered with id 0
+	done chan struct{} // closed when wait returns
+}
+
+func newPoller() (poller, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	p := &epoll{fd: fd, done: make(chan struct{})}
+	if err := syscall.Pipe2(p.pipe[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN}
+	if err := syscall.EpollCtl(fd, syscall.EPOLL_CTL_ADD, p.pipe[0], &ev); err != nil {
+		p.release()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *epoll) release() {
+	syscall.Close(p.fd)
+	syscall.Close(p.pipe[0])
+	syscall.Close(p.pipe[1])
+}
+
+func (p *epoll) ctl(op int, id uint64, rc syscall.RawConn) error {
+	ev := syscall.EpollEvent{Events: epollEvents, Fd: int32(id), Pad: int32(id >> 32)}
+	var err error
+	// descriptor can't be closed (and reused) while Control runs
+	if cerr := rc.Control(func(fd uintptr) {
+		err = syscall.EpollCtl(p.fd, op, int(fd), &ev)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (p *epoll) add(id uint64, rc syscall.RawConn) error {
+	return p.ctl(syscall.EPOLL_CTL_ADD, id, rc)
+}
+
+func (p *epoll) rearm(id uint64, rc syscall.RawConn) error {
+	return p.ctl(syscall.EPOLL_CTL_MOD, id, rc)
+}
+
+func (p *epoll) wait(ready func(id uint64)) error {
+	// descriptors are released by close, so that it never writes to a reused one
+	defer close(p.done)
+	events := make([]syscall.EpollEvent, 256)
+	for {
+		n, err := syscall.EpollWait(p.fd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("epoll_wait: %w", err)
+		}
+		for i := 0; i < n; i++ {
+			id := uint64(uint32(events[i].Fd)) | uint64(uint32(events[i].Pad))<<32
+			if id == 0 {
+				return nil
+			}
+			ready(id)
+		}
+	}
+}
+
+func (p *epoll) close() {
+	syscall.Write(p.pipe[1], []byte{0})
+	<-p.done
+	p.release()
+}
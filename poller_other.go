@@ -0,0 +1,11 @@
+//go:build !linux
+
+package websocket
+
+import (
+	"errors"
+)
+
+func newPoller() (poller, error) {
+	return nil, errors.New("event loop is supported on linux only")
+}
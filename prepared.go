@@ -0,0 +1,102 @@
+package websocket
+
+import (
+	"sync"
+)
+
+// PreparedMessage keeps frame of a message encoded once for many connections.
+// Compressed variant is made on the first send to connection with permessage-deflate
+// and is shared by connections with the same compression level.
+type PreparedMessage struct {
+	opcode uint8
+	body   []byte
+	mu     sync.RWMutex
+	frames map[preparedKey][]byte
+}
+
+type preparedKey struct {
+	compressed bool
+	level      int
+}
+
+// NewPreparedMessage prepares message, body must not be modified after
+func NewPreparedMessage(opcode uint8, body []byte) *PreparedMessage {
+	if opcode >= OPCODE_CLOSE && len(body) > MaxControlFrameLength {
+		panic("control frame exceeds max data length")
+	}
+	return &PreparedMessage{
+		opcode: opcode,
+		body:   body,
+		frames: make(map[preparedKey][]byte, 1),
+	}
+}
+
+// frame returns encoded frame for connection with deflate state ds (nil without compression)
+func (pm *PreparedMessage) frame(ds *deflateState) ([]byte, error) {
+	var key preparedKey
+	if ds != nil && (pm.opcode == OPCODE_TEXT || pm.opcode == OPCODE_BINARY) && len(pm.body) >= ds.threshold {
+		key = preparedKey{compressed: true, level: ds.level}
+	}
+	pm.mu.RLock()
+	b, ok := pm.frames[key]
+	pm.mu.RUnlock()
+	if ok {
+		return b, nil
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	// encoded by another connection meanwhile
+	if b, ok := pm.frames[key]; ok {
+		return b, nil
+	}
+	body := pm.body
+	if key.compressed {
+		var err error
+		if body, err = ds.compress(body); err != nil {
+			return nil, err
+		}
+		defer putBuffer(body)
+	}
+	f := Frame{Fin: true, Rsv1: key.compressed, Opcode: pm.opcode, Len: len(body)}
+	var hdr [14]byte
+	h := f.encodeHeader(&hdr)
+	b = make([]byte, 0, len(h)+len(body))
+	b = append(append(b, h...), body...)
+	pm.frames[key] = b
+	return b, nil
+}
+
+// SendPrepared writes prepared frame with a single buffered write, it is safe for concurrent use.
+// Frames of client connections are masked and compression with context takeover depends
+// on previous messages, so such connections encode the message as Send does.
+func (wsc *Connection) SendPrepared(pm *PreparedMessage) error {
+	if wsc.client || pm.opcode == OPCODE_CLOSE || (wsc.deflate != nil && !wsc.deflate.outNoContextTakeover) {
+		return wsc.Send(&Message{pm.opcode, pm.body})
+	}
+	b, err := pm.frame(wsc.deflate)
+	if err != nil {
+		return err
+	}
+	if pm.opcode == OPCODE_TEXT || pm.opcode == OPCODE_BINARY {
+		wsc.msgMu.Lock()
+		defer wsc.msgMu.Unlock()
+	}
+	wsc.wmu.Lock()
+	defer wsc.wmu.Unlock()
+	if wsc.hasState(stateWriteBroken) {
+		return ErrConnectionBroken
+	}
+	if wsc.hasState(stateCloseSent | stateClosed) {
+		return ErrConnectionClosed
+	}
+	wsc.acquireWriter(wsc.config.WsWriteBuffer)
+	defer wsc.releaseWriter()
+	if _, err := wsc.w.Write(b); err != nil {
+		return err
+	}
+	wsc.shard.outFrame(pm.opcode)
+	if wsc.LogLevel >= LOG_DEBUG {
+		wsc.LogDebug("prepared frame sent: opcode %d, %d bytes", pm.opcode, len(b))
+	}
+	return wsc.w.Flush()
+}
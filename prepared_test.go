@@ -0,0 +1,105 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestSendPreparedCompressed(t *testing.T) {
+	body := bytes.Repeat([]byte("prepared message "), 100)
+
+	t.Run("no context takeover", func(t *testing.T) {
+		pm := NewPreparedMessage(OPCODE_TEXT, body)
+		for i := 0; i < 2; i++ {
+			srv, cli := newTestPair(t, Config{Compression: true})
+			if srv.deflate == nil || !srv.deflate.outNoContextTakeover {
+				t.Fatal("compression without context takeover expected")
+			}
+			// twice, so that the cached frame is reused by the same connection too
+			for j := 0; j < 2; j++ {
+				if err := srv.SendPrepared(pm); err != nil {
+					t.Fatal(err)
+				}
+				m, err := cli.Recv()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if m.Opcode != OPCODE_TEXT || !bytes.Equal(m.Body, body) {
+					t.Fatalf("got %s", m)
+				}
+			}
+		}
+		if len(pm.frames) != 1 {
+			t.Fatalf("%d frames cached, 1 expected", len(pm.frames))
+		}
+		b, ok := pm.frames[preparedKey{compressed: true, level: DefaultCompressionLevel}]
+		if !ok {
+			t.Fatal("compressed frame is not cached")
+		}
+		if b[0]&0x40 == 0 || len(b) >= len(body) {
+			t.Errorf("cached frame is not compressed: rsv1 %v, %d bytes", b[0]&0x40 != 0, len(b))
+		}
+	})
+
+	t.Run("context takeover", func(t *testing.T) {
+		pm := NewPreparedMessage(OPCODE_TEXT, body)
+		srv, cli := newTestPair(t, Config{Compression: true, CompressionContextTakeover: true})
+		if srv.deflate == nil || srv.deflate.outNoContextTakeover {
+			t.Fatal("compression with context takeover expected")
+		}
+		// every message depends on the previous ones, so it is compressed by Send
+		for j := 0; j < 3; j++ {
+			if err := srv.SendPrepared(pm); err != nil {
+				t.Fatal(err)
+			}
+			m, err := cli.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Opcode != OPCODE_TEXT || !bytes.Equal(m.Body, body) {
+				t.Fatalf("got %s", m)
+			}
+		}
+		if len(pm.frames) != 0 {
+			t.Errorf("%d frames cached, none expected", len(pm.frames))
+		}
+	})
+}
+
+func BenchmarkSendPrepared(b *testing.B) {
+	body := bytes.Repeat([]byte("prepared message "), 100)
+	configs := []struct {
+		name   string
+		config Config
+	}{
+		{"plain", Config{}},
+		{"compressed", Config{Compression: true}},
+	}
+	for _, c := range configs {
+		b.Run(c.name+"/Send", func(b *testing.B) {
+			srv, cli := newTestPair(b, c.config)
+			go io.Copy(io.Discard, cli.conn)
+			msg := &Message{OPCODE_TEXT, body}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := srv.Send(msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(c.name+"/SendPrepared", func(b *testing.B) {
+			srv, cli := newTestPair(b, c.config)
+			go io.Copy(io.Discard, cli.conn)
+			pm := NewPreparedMessage(OPCODE_TEXT, body)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := srv.SendPrepared(pm); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
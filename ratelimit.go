@@ -0,0 +1,134 @@
+package websocket
+
+import (
+	"time"
+)
+
+// RateLimitAction tells what to do with connection exceeding its RateLimit
+type RateLimitAction uint8
+
+const (
+	RateLimitDelay RateLimitAction = iota // stop reading until the limit allows, TCP flow control slows the peer down
+	RateLimitClose                        // send close frame with STATUS_POLICY, reads fail with ErrRateLimited
+)
+
+// RateLimit limits frames received by connection, zero fields are not limited.
+// Every limit allows a burst of one second worth of it.
+type RateLimit struct {
+	Messages int // data messages per second, continuation frames are not counted
+	Bytes    int // payload bytes per second of data and control frames
+	Control  int // ping and pong frames per second
+	Action   RateLimitAction
+}
+
+func (rl RateLimit) enabled() bool {
+	return rl.Messages > 0 || rl.Bytes > 0 || rl.Control > 0
+}
+
+// delay is slept in steps, so that closed connection does not wait for the rest
+const rateLimitStep = 100 * time.Millisecond
+
+// rateLimiter is touched only by reading goroutine with rmu held
+type rateLimiter struct {
+	wsc      *Connection
+	action   RateLimitAction
+	messages tokenBucket
+	bytes    tokenBucket
+	control  tokenBucket
+}
+
+// tokenBucket is refilled at rate tokens per second up to rate, zero rate is not limited
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   int64 // unix nanos of the last refill
+}
+
+func newTokenBucket(rate int, now int64) tokenBucket {
+	return tokenBucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+// take removes n tokens and returns time to wait until the balance is not negative
+func (tb *tokenBucket) take(n int, now int64) time.Duration {
+	if tb.rate <= 0 {
+		return 0
+	}
+	tb.tokens += float64(now-tb.last) * tb.rate / float64(time.Second)
+	if tb.tokens > tb.rate {
+		tb.tokens = tb.rate
+	}
+	tb.last = now
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+func newRateLimiter(wsc *Connection, rl RateLimit) *rateLimiter {
+	now := time.Now().UnixNano()
+	return &rateLimiter{
+		wsc:      wsc,
+		action:   rl.Action,
+		messages: newTokenBucket(rl.Messages, now),
+		bytes:    newTokenBucket(rl.Bytes, now),
+		control:  newTokenBucket(rl.Control, now),
+	}
+}
+
+// startRateLimit applies Config.RateLimit unless handshake set limits of the connection
+func (wsc *Connection) startRateLimit() {
+	if wsc.limiter == nil && wsc.config.RateLimit.enabled() {
+		wsc.limiter = newRateLimiter(wsc, wsc.config.RateLimit)
+	}
+}
+
+// received is called for every frame header read from the peer, close frames are not limited
+func (rl *rateLimiter) received(opcode uint8, length int) error {
+	if opcode == OPCODE_CLOSE {
+		return nil
+	}
+	now := time.Now().UnixNano()
+	wait := rl.bytes.take(length, now)
+	var d time.Duration
+	switch opcode {
+	case OPCODE_TEXT, OPCODE_BINARY:
+		d = rl.messages.take(1, now)
+	case OPCODE_PING, OPCODE_PONG:
+		d = rl.control.take(1, now)
+	}
+	if d > wait {
+		wait = d
+	}
+	if wait == 0 {
+		return nil
+	}
+	wsc := rl.wsc
+	if rl.action == RateLimitClose {
+		wsc.stats.rateLimitClose()
+		wsc.LogInfo("rate limit exceeded, closing connection")
+		// payload of the frame is left unread
+		wsc.setState(stateReadBroken)
+		wsc.kick(STATUS_POLICY, "rate limit exceeded")
+		return ErrRateLimited
+	}
+	wsc.stats.rateLimitDelay()
+	if wsc.LogLevel >= LOG_DEBUG {
+		wsc.LogDebug("rate limit exceeded, reading delayed for %s", wait)
+	}
+	for wait > 0 && !wsc.hasState(stateClosed) {
+		d := wait
+		if d > rateLimitStep {
+			d = rateLimitStep
+		}
+		time.Sleep(d)
+		wait -= d
+	}
+	return nil
+}
+
+// SetRateLimit overrides Config.RateLimit for this connection, e.g. from HandshakeFunc.
+// It must not be called concurrently with reads.
+func (wsc *Connection) SetRateLimit(rl RateLimit) {
+	wsc.limiter = newRateLimiter(wsc, rl)
+}
@@ -0,0 +1,97 @@
+package websocket
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newLimitedPair connects client to server which limits frames received from it
+func newLimitedPair(t *testing.T, rl RateLimit) (srv, cli *Connection) {
+	t.Helper()
+	srv, cli = newTestPair(t, Config{RateLimit: rl, CloseTimeout: time.Second})
+	// the same config is taken by client, but only the server side is tested
+	cli.SetRateLimit(RateLimit{})
+	return srv, cli
+}
+
+func TestRateLimitClose(t *testing.T) {
+	srv, cli := newLimitedPair(t, RateLimit{Messages: 5, Action: RateLimitClose})
+	for i := 0; i < 6; i++ {
+		if err := cli.SendText([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// burst of one second is allowed
+	for i := 0; i < 5; i++ {
+		if _, err := srv.Recv(); err != nil {
+			t.Fatalf("message %d: %s", i, err)
+		}
+	}
+	if _, err := srv.Recv(); err != ErrRateLimited {
+		t.Fatalf("err = %v, %v expected", err, ErrRateLimited)
+	}
+	if _, err := srv.Recv(); err != ErrConnectionBroken {
+		t.Errorf("err = %v, %v expected", err, ErrConnectionBroken)
+	}
+	// messages sent before the limit was exceeded come first
+	var err error
+	for err == nil {
+		_, err = cli.Recv()
+	}
+	var ce *CloseError
+	if !errors.As(err, &ce) || ce.Code != STATUS_POLICY {
+		t.Errorf("err = %v, close %d expected", err, STATUS_POLICY)
+	}
+	if ss := srv.stats.Snapshot(); ss.RateLimitCloses != 1 || ss.RateLimitDelays != 0 {
+		t.Errorf("closes %d, delays %d, 1 and 0 expected", ss.RateLimitCloses, ss.RateLimitDelays)
+	}
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	// every case sends a burst and a half, the rest takes half a second
+	const n = 15
+	tests := []struct {
+		name  string
+		limit RateLimit
+		send  func(cli *Connection) error
+	}{
+		{
+			name:  "messages",
+			limit: RateLimit{Messages: 10},
+			send:  func(cli *Connection) error { return cli.SendText([]byte("hello")) },
+		},
+		{
+			name:  "bytes",
+			limit: RateLimit{Bytes: 10000},
+			send:  func(cli *Connection) error { return cli.SendBinary(make([]byte, 1000)) },
+		},
+		{
+			name:  "control",
+			limit: RateLimit{Control: 10},
+			send:  func(cli *Connection) error { return cli.SendPing([]byte("ping")) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, cli := newLimitedPair(t, tt.limit)
+			start := time.Now()
+			for i := 0; i < n; i++ {
+				if err := tt.send(cli); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < n; i++ {
+				if _, err := srv.Recv(); err != nil {
+					t.Fatalf("message %d: %s", i, err)
+				}
+			}
+			if d := time.Since(start); d < 400*time.Millisecond {
+				t.Errorf("received in %s, half a second expected", d)
+			}
+			if ss := srv.stats.Snapshot(); ss.RateLimitDelays == 0 || ss.RateLimitCloses != 0 {
+				t.Errorf("delays %d, closes %d", ss.RateLimitDelays, ss.RateLimitCloses)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package websocket
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var lastConnectionID uint64
+
+// ids are unique within the process, 0 is never used
+func nextConnectionID() uint64 {
+	return atomic.AddUint64(&lastConnectionID, 1)
+}
+
+// registry keeps open server connections by id, split into shards
+// so that connects and disconnects on different cores do not wait for each other
+const registryShards = 64
+
+type registry struct {
+	count  int64
+	closed uint32 // set by server shutdown, new connections are not accepted
+	shards [registryShards]registryShard
+}
+
+type registryShard struct {
+	mu    sync.RWMutex
+	conns map[uint64]*Connection
+}
+
+func newRegistry() *registry {
+	r := &registry{}
+	for i := range r.shards {
+		r.shards[i].conns = make(map[uint64]*Connection)
+	}
+	return r
+}
+
+func (r *registry) shard(id uint64) *registryShard {
+	return &r.shards[id%registryShards]
+}
+
+// add returns false after close, the flag is checked under shard lock,
+// so close followed by each() never misses a connection
+func (r *registry) add(wsc *Connection) bool {
+	sh := r.shard(wsc.id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if atomic.LoadUint32(&r.closed) != 0 {
+		return false
+	}
+	if _, ok := sh.conns[wsc.id]; !ok {
+		sh.conns[wsc.id] = wsc
+		atomic.AddInt64(&r.count, 1)
+	}
+	return true
+}
+
+func (r *registry) remove(wsc *Connection) {
+	sh := r.shard(wsc.id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.conns[wsc.id]; ok {
+		delete(sh.conns, wsc.id)
+		atomic.AddInt64(&r.count, -1)
+	}
+}
+
+func (r *registry) get(id uint64) *Connection {
+	sh := r.shard(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.conns[id]
+}
+
+func (r *registry) close() {
+	atomic.StoreUint32(&r.closed, 1)
+}
+
+func (r *registry) len() int {
+	return int(atomic.LoadInt64(&r.count))
+}
+
+// each calls f for every connection until it returns false. Shard is copied before the calls,
+// so f may close connections, connections added meanwhile may be missed.
+func (r *registry) each(f func(wsc *Connection) bool) {
+	var buf []*Connection
+	for i := range r.shards {
+		sh := &r.shards[i]
+		sh.mu.RLock()
+		buf = buf[:0]
+		for _, wsc := range sh.conns {
+			buf = append(buf, wsc)
+		}
+		sh.mu.RUnlock()
+		for _, wsc := range buf {
+			if !f(wsc) {
+				return
+			}
+		}
+	}
+}
+
+//////////////// Server API ////////////////////
+
+// Connection returns open connection by id or nil
+func (s *Server) Connection(id uint64) *Connection {
+	return s.conns.get(id)
+}
+
+// Range calls f for every open connection until f returns false.
+// Connections opened or closed during Range may be skipped.
+func (s *Server) Range(f func(wsc *Connection) bool) {
+	s.conns.each(f)
+}
+
+// Count returns number of open connections
+func (s *Server) Count() int {
+	return s.conns.len()
+}
+
+// Kick sends close frame with code and reason to connection, its handler gets the answer
+// as usual. Connection is closed forcibly if peer does not answer within CloseTimeout.
+func (s *Server) Kick(id uint64, code uint16, reason string) error {
+	wsc := s.conns.get(id)
+	if wsc == nil {
+		return ErrUnknownConnection
+	}
+	return wsc.kick(code, reason)
+}
@@ -1,45 +1,88 @@
 package websocket
 
 import (
+	"compress/flate"
+	"context"
 	"crypto/tls"
-	"log"
+	"errors"
 	"net"
+	"net/http"
+	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Server struct {
-	Config *Config
-	Stats  *Stats
+	Config    *Config
+	Stats     *Stats
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     *registry
+	shutdown  bool
+	loop      *eventLoop
 }
 
 type Config struct {
-	Handshake             HandshakeFunc
-	Addr                  string
-	CertFile              string
-	KeyFile               string
-	MaxMsgLen             int
-	SockReadBuffer        int
-	SockWriteBuffer       int
-	HttpReadBuffer        int
-	HttpWriteBuffer       int
-	WsReadBuffer          int
-	WsWriteBuffer         int
-	IOStatistics          bool
-	LogLevel              uint8
-	CloseTimeout          time.Duration
-	HandshakeReadTimeout  time.Duration
-	HandshakeWriteTimeout time.Duration
-	TCPKeepAlive          time.Duration
+	Handshake                  HandshakeFunc
+	Addr                       string
+	CertFile                   string
+	KeyFile                    string
+	MaxMsgLen                  int
+	FragmentSize               int
+	SockReadBuffer             int
+	SockWriteBuffer            int
+	HttpReadBuffer             int
+	HttpWriteBuffer            int
+	WsReadBuffer               int
+	WsWriteBuffer              int
+	IOStatistics               bool
+	EventLoop                  bool
+	EventWorkers               int
+	CheckOrigin                func(req *http.Request) bool
+	AllowedOrigins             []string
+	Subprotocols               []string
+	SelectSubprotocol          func(wsc *Connection, offered []string) string
+	SubprotocolRequired        bool
+	SkipUTF8Validation         bool
+	Compression                bool
+	CompressionLevel           int
+	CompressionThreshold       int
+	CompressionContextTakeover bool
+	LogLevel                   uint8
+	Logger                     Logger
+	CloseTimeout               time.Duration
+	PingInterval               time.Duration
+	PongTimeout                time.Duration
+	IdleTimeout                time.Duration
+	HandshakeReadTimeout       time.Duration
+	HandshakeWriteTimeout      time.Duration
+	TCPKeepAlive               time.Duration
+	RateLimit                  RateLimit
 }
 
 func NewServer(config Config) *Server {
 	if config.Handshake == nil {
 		panic("config.Handshake is not set")
 	}
-	if config.Addr == "" {
-		panic("config.Addr is not set")
+	config.setDefaults()
+	s := &Server{
+		Config:    &config,
+		Stats:     newStats(),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     newRegistry(),
+	}
+	if config.EventLoop {
+		loop, err := newEventLoop(s.Config)
+		if err != nil {
+			config.Logger.Log(LOG_WARN, "event loop disabled", "err", err)
+		}
+		s.loop = loop
 	}
+	return s
+}
+
+func (config *Config) setDefaults() {
 	if config.SockReadBuffer == 0 {
 		config.SockReadBuffer = DefaultSockReadBuffer
 	}
@@ -61,27 +104,54 @@ func NewServer(config Config) *Server {
 	if config.MaxMsgLen == 0 {
 		config.MaxMsgLen = DefaultMaxMsgLen
 	}
+	if config.FragmentSize == 0 {
+		config.FragmentSize = DefaultFragmentSize
+	}
 	if config.HandshakeReadTimeout == 0 {
 		config.HandshakeReadTimeout = DefaultHandshakeReadTimeout
 	}
 	if config.HandshakeWriteTimeout == 0 {
 		config.HandshakeWriteTimeout = DefaultHandshakeWriteTimeout
 	}
+	if config.EventWorkers == 0 {
+		config.EventWorkers = DefaultEventWorkersPerCPU * runtime.NumCPU()
+	}
 	if config.CloseTimeout == 0 {
 		config.CloseTimeout = DefaultCloseTimeout
 	}
-	s := &Server{
-		Config: &config,
-		Stats:  newStats(),
+	if config.PingInterval > 0 && config.PongTimeout == 0 {
+		config.PongTimeout = config.PingInterval
+	}
+	if config.CompressionLevel == 0 {
+		config.CompressionLevel = DefaultCompressionLevel
+	}
+	if config.CompressionLevel < flate.HuffmanOnly || config.CompressionLevel > flate.BestCompression {
+		panic("config.CompressionLevel is invalid")
+	}
+	if config.CompressionThreshold == 0 {
+		config.CompressionThreshold = DefaultCompressionThreshold
+	}
+	if config.Logger == nil {
+		config.Logger = StdLogger{}
 	}
-	return s
 }
 
-func (s *Server) serve(ln net.Listener) {
+func (s *Server) serve(ln net.Listener) error {
+	if !s.trackListener(ln, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("ERROR: Failed to accept connection %s", err)
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			s.Config.Logger.Log(LOG_ERROR, "failed to accept connection", "err", err)
 			time.Sleep(AcceptErrorTimeout)
 			continue
 		}
@@ -93,15 +163,25 @@ func (s *Server) serve(ln net.Listener) {
 }
 
 func (s *Server) Serve() (err error) {
+	if s.Config.Addr == "" {
+		panic("config.Addr is not set")
+	}
 	ln, err := net.Listen("tcp", s.Config.Addr)
 	if err != nil {
 		return err
 	}
-	s.serve(ln)
-	return
+	return s.ServeListener(ln)
+}
+
+// ServeListener accepts connections on any listener: TCP, unix socket, TLS, PROXY protocol wrappers etc.
+func (s *Server) ServeListener(ln net.Listener) error {
+	return s.serve(ln)
 }
 
 func (s *Server) ServeTLS() (err error) {
+	if s.Config.Addr == "" {
+		panic("config.Addr is not set")
+	}
 	ln, err := net.Listen("tcp", s.Config.Addr)
 	if err != nil {
 		return err
@@ -152,6 +232,97 @@ func (s *Server) ServeTLS() (err error) {
 		return err
 	}
 	tlsLn := tls.NewListener(ln, config)
-	s.serve(tlsLn)
-	return
+	return s.ServeListener(tlsLn)
+}
+
+//////////////// Shutdown ////////////////////
+
+const shutdownPollInterval = 50 * time.Millisecond
+
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.shutdown {
+			return false
+		}
+		s.listeners[ln] = struct{}{}
+	} else {
+		delete(s.listeners, ln)
+	}
+	return true
+}
+
+func (s *Server) trackConn(wsc *Connection, add bool) bool {
+	if add {
+		return s.conns.add(wsc)
+	}
+	s.conns.remove(wsc)
+	return true
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shutdown
+}
+
+func (s *Server) activeConns() []*Connection {
+	conns := make([]*Connection, 0, s.conns.len())
+	s.conns.each(func(wsc *Connection) bool {
+		conns = append(conns, wsc)
+		return true
+	})
+	return conns
+}
+
+// Shutdown stops accepting new connections, sends close frame with STATUS_GOAWAY
+// to every open connection and waits for close handshakes up to CloseTimeout
+// or ctx deadline. Remaining connections are closed forcibly.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shutdown = true
+	s.conns.close()
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	s.mu.Unlock()
+
+	// parked connections need poller till the end
+	defer s.loop.stop()
+	// the wait starts first, so that close frame stuck behind a blocked write does not stall Shutdown
+	timer := time.NewTimer(s.Config.CloseTimeout)
+	defer timer.Stop()
+	for _, wsc := range s.activeConns() {
+		go func(wsc *Connection) {
+			if err := wsc.SendClose(STATUS_GOAWAY, "server shutdown"); err != nil && err != ErrConnectionClosed {
+				wsc.LogDebug("shutdown: %s", err)
+			}
+		}(wsc)
+	}
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.conns.len() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			s.closeConns()
+			return ctx.Err()
+		case <-timer.C:
+			s.closeConns()
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) closeConns() {
+	for _, wsc := range s.activeConns() {
+		wsc.LogDebug("shutdown: closing connection forcibly")
+		// socket only, connection goroutine (or event loop worker) finishes the rest
+		wsc.conn.Close()
+		wsc.wake()
+	}
 }
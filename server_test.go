@@ -0,0 +1,51 @@
+package websocket
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdownBlockedWriter(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flooding := make(chan struct{})
+	s := NewServer(Config{
+		Handshake: func(wsc *Connection, req *http.Request, w http.ResponseWriter) HandlerFunc {
+			return func(wsc *Connection) error {
+				close(flooding)
+				b := make([]byte, 64*1024)
+				for {
+					if err := wsc.SendBinary(b); err != nil {
+						return err
+					}
+				}
+			}
+		},
+	})
+	go s.ServeListener(ln)
+	// client does not read
+	cli, err := Dial(context.Background(), "ws://"+ln.Addr().String(), DialConfig{Stats: newStats()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	<-flooding
+	// let socket buffers fill up
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = s.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v, %v expected", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Shutdown took %s", d)
+	}
+}
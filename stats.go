@@ -3,7 +3,8 @@ package websocket
 import (
 	"fmt"
 	"io"
-	"log"
+	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,32 +15,37 @@ const (
 	rpsTimeSlice = 30 * time.Second
 )
 
-type RpsCounter struct {
-	Count uint64
+// rpsCounter keeps timestamps of the last events in a ring, slots are taken atomically
+type rpsCounter struct {
+	count uint64
+	i     uint64
 	buf   []int64
-	i     int
 }
 
-func newEvStat() *RpsCounter {
-	rc := &RpsCounter{}
+func newRpsCounter() *rpsCounter {
+	rc := &rpsCounter{}
 	rc.buf = make([]int64, rpsBufLen)
 	return rc
 }
 
-func (rc *RpsCounter) inc() {
-	rc.Count++
-	ts := time.Now().UnixNano()
-	rc.buf[rc.i] = ts
-	rc.i = (rc.i + 1) % len(rc.buf)
+func (rc *rpsCounter) inc() {
+	atomic.AddUint64(&rc.count, 1)
+	i := atomic.AddUint64(&rc.i, 1) - 1
+	atomic.StoreInt64(&rc.buf[i%uint64(len(rc.buf))], time.Now().UnixNano())
 }
 
-func (rc *RpsCounter) Rps() float64 {
+func (rc *rpsCounter) Count() uint64 {
+	return atomic.LoadUint64(&rc.count)
+}
+
+func (rc *rpsCounter) Rps() float64 {
 	now := time.Now().UnixNano()
 	since := now - int64(rpsTimeSlice)
 	tsMin := now
 	tsMax := since
 	n := 0
-	for _, ts := range rc.buf {
+	for i := range rc.buf {
+		ts := atomic.LoadInt64(&rc.buf[i])
 		if ts == 0 || ts < since || ts > now {
 			continue
 		}
@@ -60,153 +66,230 @@ func (rc *RpsCounter) Rps() float64 {
 	return res
 }
 
-func (rc *RpsCounter) String() string {
-	return fmt.Sprintf("%d (%.2f)", rc.Count, rc.Rps())
-}
-
 //////////////////////////////////////////////////////////
 
 type ReaderWithStats struct {
 	r     io.Reader
-	stats *Stats
+	shard *statsShard
 }
 
 func (rws *ReaderWithStats) Read(b []byte) (n int, err error) {
-	rws.stats.add(eventReadStart{})
+	atomic.AddInt64(&rws.shard.reading, 1)
 	n, err = rws.r.Read(b)
-	rws.stats.add(eventReadStop{})
+	atomic.AddInt64(&rws.shard.reading, -1)
 	return
 }
 
 type WriterWithStats struct {
 	w     io.Writer
-	stats *Stats
+	shard *statsShard
 }
 
 func (wws *WriterWithStats) Write(b []byte) (n int, err error) {
-	wws.stats.add(eventWriteStart{})
+	atomic.AddInt64(&wws.shard.writing, 1)
 	n, err = wws.w.Write(b)
-	wws.stats.add(eventWriteStop{})
+	atomic.AddInt64(&wws.shard.writing, -1)
+	return
+}
+
+// writeBuffers keeps vectored write, *net.TCPConn makes it with writev
+func (wws *WriterWithStats) writeBuffers(bufs *net.Buffers) (n int64, err error) {
+	atomic.AddInt64(&wws.shard.writing, 1)
+	n, err = bufs.WriteTo(wws.w)
+	atomic.AddInt64(&wws.shard.writing, -1)
 	return
 }
 
 //////////////////////////////////////////////////////////
 
+// counters updated by connection on every frame and read are sharded,
+// so that connections running on different cores don't fight for one cache line
+const statsShards = 32
+
+type statsShard struct {
+	reading   int64
+	writing   int64
+	parked    int64
+	inFrames  [maxOpcode + 1]uint64
+	outFrames [maxOpcode + 1]uint64
+	_         [64]byte
+}
+
+// Stats are updated with atomics right by connection goroutines,
+// use Snapshot to read them
 type Stats struct {
-	Connections        uint64
-	MaxConnections     uint64
-	ConnectionsReading uint64
-	ConnectionsWriting uint64
-	Handshakes         *RpsCounter
-	HandshakesFailed   *RpsCounter
-	InFrames           map[uint8]*RpsCounter
-	OutFrames          map[uint8]*RpsCounter
-	channel            chan interface{}
+	connections      uint64
+	maxConnections   uint64
+	shards           [statsShards]statsShard
+	handshakes       *rpsCounter
+	handshakesFailed *rpsCounter
+	peerTimeouts     *rpsCounter
+	rateLimitDelays  *rpsCounter
+	rateLimitCloses  *rpsCounter
+	next             uint32 // shard of the next connection
+}
+
+// StatsSnapshot is a copy of Stats, frames are indexed by opcode
+type StatsSnapshot struct {
+	Connections         uint64
+	MaxConnections      uint64
+	ConnectionsReading  uint64
+	ConnectionsWriting  uint64
+	ConnectionsParked   uint64 // waiting in event loop without goroutine
+	ConnectionsActive   uint64 // served by goroutine
+	Handshakes          uint64
+	HandshakesFailed    uint64
+	PeerTimeouts        uint64
+	RateLimitDelays     uint64 // reads delayed by RateLimit
+	RateLimitCloses     uint64 // connections closed by RateLimit
+	HandshakesRps       float64
+	HandshakesFailedRps float64
+	PeerTimeoutsRps     float64
+	RateLimitDelaysRps  float64
+	RateLimitClosesRps  float64
+	InFrames            [maxOpcode + 1]uint64
+	OutFrames           [maxOpcode + 1]uint64
+}
+
+func newStats() *Stats {
+	return &Stats{
+		handshakes:       newRpsCounter(),
+		handshakesFailed: newRpsCounter(),
+		peerTimeouts:     newRpsCounter(),
+		rateLimitDelays:  newRpsCounter(),
+		rateLimitCloses:  newRpsCounter(),
+	}
+}
+
+// Snapshot sums counters of all shards. It is not an atomic snapshot: counters are read
+// one by one while connections keep updating them, so they may be off by in-flight events
+// relative to each other. Gauges are clamped to [0, Connections] and MaxConnections is
+// not below Connections, nothing else is guaranteed to add up.
+func (st *Stats) Snapshot() StatsSnapshot {
+	var ss StatsSnapshot
+	var reading, writing, parked int64
+	for i := range st.shards {
+		sh := &st.shards[i]
+		reading += atomic.LoadInt64(&sh.reading)
+		writing += atomic.LoadInt64(&sh.writing)
+		parked += atomic.LoadInt64(&sh.parked)
+		for op := range sh.inFrames {
+			ss.InFrames[op] += atomic.LoadUint64(&sh.inFrames[op])
+			ss.OutFrames[op] += atomic.LoadUint64(&sh.outFrames[op])
+		}
+	}
+	ss.Connections = atomic.LoadUint64(&st.connections)
+	ss.MaxConnections = atomic.LoadUint64(&st.maxConnections)
+	if ss.MaxConnections < ss.Connections {
+		ss.MaxConnections = ss.Connections
+	}
+	ss.ConnectionsReading = clampGauge(reading, ss.Connections)
+	ss.ConnectionsWriting = clampGauge(writing, ss.Connections)
+	ss.ConnectionsParked = clampGauge(parked, ss.Connections)
+	ss.ConnectionsActive = ss.Connections - ss.ConnectionsParked
+	ss.Handshakes = st.handshakes.Count()
+	ss.HandshakesFailed = st.handshakesFailed.Count()
+	ss.PeerTimeouts = st.peerTimeouts.Count()
+	ss.HandshakesRps = st.handshakes.Rps()
+	ss.HandshakesFailedRps = st.handshakesFailed.Rps()
+	ss.PeerTimeoutsRps = st.peerTimeouts.Rps()
+	ss.RateLimitDelays = st.rateLimitDelays.Count()
+	ss.RateLimitCloses = st.rateLimitCloses.Count()
+	ss.RateLimitDelaysRps = st.rateLimitDelays.Rps()
+	ss.RateLimitClosesRps = st.rateLimitCloses.Rps()
+	return ss
+}
+
+// clampGauge keeps sum of shards read at different moments within [0, max]
+func clampGauge(v int64, max uint64) uint64 {
+	if v < 0 {
+		return 0
+	}
+	if uint64(v) > max {
+		return max
+	}
+	return uint64(v)
 }
 
 func (st *Stats) String() string {
+	return st.Snapshot().String()
+}
+
+func (ss StatsSnapshot) String() string {
 	s := ""
-	s += fmt.Sprintf("Connections: %d\n", st.Connections)
-	s += fmt.Sprintf("  Max: %d\n", st.MaxConnections)
-	s += fmt.Sprintf("  Reading: %d\n", st.ConnectionsReading)
-	s += fmt.Sprintf("  Wriring: %d\n", st.ConnectionsWriting)
-	s += fmt.Sprintf("Handshakes: %s\n", st.Handshakes)
-	s += fmt.Sprintf("HandshakesFailed: %s\n", st.HandshakesFailed)
+	s += fmt.Sprintf("Connections: %d\n", ss.Connections)
+	s += fmt.Sprintf("  Max: %d\n", ss.MaxConnections)
+	s += fmt.Sprintf("  Reading: %d\n", ss.ConnectionsReading)
+	s += fmt.Sprintf("  Wriring: %d\n", ss.ConnectionsWriting)
+	s += fmt.Sprintf("  Parked: %d\n", ss.ConnectionsParked)
+	s += fmt.Sprintf("  Active: %d\n", ss.ConnectionsActive)
+	s += fmt.Sprintf("Handshakes: %d (%.2f)\n", ss.Handshakes, ss.HandshakesRps)
+	s += fmt.Sprintf("HandshakesFailed: %d (%.2f)\n", ss.HandshakesFailed, ss.HandshakesFailedRps)
+	s += fmt.Sprintf("PeerTimeouts: %d (%.2f)\n", ss.PeerTimeouts, ss.PeerTimeoutsRps)
+	s += fmt.Sprintf("RateLimitDelays: %d (%.2f)\n", ss.RateLimitDelays, ss.RateLimitDelaysRps)
+	s += fmt.Sprintf("RateLimitCloses: %d (%.2f)\n", ss.RateLimitCloses, ss.RateLimitClosesRps)
 	s += "InFrames\n"
 	for _, opcode := range KnownOpcodes {
-		s += fmt.Sprintf("  %d: %s\n", opcode, st.InFrames[opcode])
+		s += fmt.Sprintf("  %d: %d\n", opcode, ss.InFrames[opcode])
 	}
 	s += "OutFrames\n"
 	for _, opcode := range KnownOpcodes {
-		s += fmt.Sprintf("  %d: %s\n", opcode, st.OutFrames[opcode])
+		s += fmt.Sprintf("  %d: %d\n", opcode, ss.OutFrames[opcode])
 	}
 	return s
 }
 
-func newStats() *Stats {
-	s := &Stats{}
-	s.Handshakes = newEvStat()
-	s.HandshakesFailed = newEvStat()
-	s.InFrames = make(map[uint8]*RpsCounter, 10)
-	s.OutFrames = make(map[uint8]*RpsCounter, 10)
-	for _, opcode := range KnownOpcodes {
-		s.InFrames[opcode] = newEvStat()
-		s.OutFrames[opcode] = newEvStat()
-	}
-	s.channel = make(chan interface{}, 1024)
-	go s.handler()
-	return s
+// shard returns counters of a new connection, connections are spread round robin
+func (st *Stats) shard() *statsShard {
+	return &st.shards[atomic.AddUint32(&st.next, 1)%statsShards]
 }
 
-type eventConnect struct{}
-type eventClose struct{}
-type eventHandshake struct{}
-type eventHandshakeFailed struct{}
-type eventReadStart struct{}
-type eventReadStop struct{}
-type eventWriteStart struct{}
-type eventWriteStop struct{}
-type eventInFrame struct{ opcode uint8 }
-type eventOutFrame struct{ opcode uint8 }
-
-func (st *Stats) add(v interface{}) {
-	st.channel <- v
-	//select {
-	//case st.channel <- v:
-	//	return
-	//default:
-	//	return
-	//}
-}
-
-func (st *Stats) handler() {
-	for ev := range st.channel {
-		switch ev := ev.(type) {
-		case eventConnect:
-			st.Connections++
-			if st.Connections > st.MaxConnections {
-				st.MaxConnections = st.Connections
-			}
-		case eventClose:
-			if st.Connections > 0 {
-				st.Connections--
-			} else {
-				log.Printf("ERROR: stats: Connections below zero")
-			}
-		case eventHandshake:
-			st.Handshakes.inc()
-		case eventHandshakeFailed:
-			st.HandshakesFailed.inc()
-		case eventReadStart:
-			st.ConnectionsReading++
-		case eventReadStop:
-			if st.ConnectionsReading > 0 {
-				st.ConnectionsReading--
-			} else {
-				log.Printf("ERROR: stats: ConnectionsReading below zero")
-			}
-		case eventWriteStart:
-			st.ConnectionsWriting++
-		case eventWriteStop:
-			if st.ConnectionsWriting > 0 {
-				st.ConnectionsWriting--
-			} else {
-				log.Printf("ERROR: stats: ConnectionsWriting below zero")
-			}
-		case eventInFrame:
-			if fs, ok := st.InFrames[ev.opcode]; ok {
-				fs.inc()
-			} else {
-				log.Printf("ERROR: stats: unknown opcode %d", ev.opcode)
-			}
-		case eventOutFrame:
-			if fs, ok := st.OutFrames[ev.opcode]; ok {
-				fs.inc()
-			} else {
-				log.Printf("ERROR: stats: unknown opcode %d", ev.opcode)
-			}
-		default:
-			panic(fmt.Sprintf("unknown stat event type %v", ev))
+func (st *Stats) connect() {
+	n := atomic.AddUint64(&st.connections, 1)
+	for {
+		max := atomic.LoadUint64(&st.maxConnections)
+		if n <= max || atomic.CompareAndSwapUint64(&st.maxConnections, max, n) {
+			return
 		}
 	}
 }
+
+func (st *Stats) disconnect() {
+	atomic.AddUint64(&st.connections, ^uint64(0))
+}
+
+func (st *Stats) handshake() {
+	st.handshakes.inc()
+}
+
+func (st *Stats) handshakeFailed() {
+	st.handshakesFailed.inc()
+}
+
+func (st *Stats) peerTimeout() {
+	st.peerTimeouts.inc()
+}
+
+func (st *Stats) rateLimitDelay() {
+	st.rateLimitDelays.inc()
+}
+
+func (st *Stats) rateLimitClose() {
+	st.rateLimitCloses.inc()
+}
+
+func (sh *statsShard) park() {
+	atomic.AddInt64(&sh.parked, 1)
+}
+
+func (sh *statsShard) wake() {
+	atomic.AddInt64(&sh.parked, -1)
+}
+
+func (sh *statsShard) inFrame(opcode uint8) {
+	atomic.AddUint64(&sh.inFrames[opcode&maxOpcode], 1)
+}
+
+func (sh *statsShard) outFrame(opcode uint8) {
+	atomic.AddUint64(&sh.outFrames[opcode&maxOpcode], 1)
+}
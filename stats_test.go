@@ -0,0 +1,66 @@
+package websocket
+
+import (
+	"runtime"
+	"testing"
+)
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// runConnections runs body by 10k goroutines, as many connections do
+func runConnections(b *testing.B, body func(pb *testing.PB)) {
+	b.ReportAllocs()
+	b.SetParallelism(10000/runtime.GOMAXPROCS(0) + 1)
+	b.RunParallel(body)
+}
+
+func BenchmarkStats(b *testing.B) {
+	b.Run("Frames", func(b *testing.B) {
+		st := newStats()
+		runConnections(b, func(pb *testing.PB) {
+			sh := st.shard()
+			for pb.Next() {
+				sh.inFrame(OPCODE_TEXT)
+				sh.outFrame(OPCODE_TEXT)
+			}
+		})
+	})
+	// all connections in one shard, for comparison
+	b.Run("FramesOneShard", func(b *testing.B) {
+		st := newStats()
+		runConnections(b, func(pb *testing.PB) {
+			sh := &st.shards[0]
+			for pb.Next() {
+				sh.inFrame(OPCODE_TEXT)
+				sh.outFrame(OPCODE_TEXT)
+			}
+		})
+	})
+	b.Run("Reader", func(b *testing.B) {
+		st := newStats()
+		runConnections(b, func(pb *testing.PB) {
+			rws := &ReaderWithStats{r: zeroReader{}, shard: st.shard()}
+			buf := make([]byte, 512)
+			for pb.Next() {
+				rws.Read(buf)
+			}
+		})
+	})
+	// connections update counters, every 1000th frame takes snapshot
+	b.Run("Snapshot", func(b *testing.B) {
+		st := newStats()
+		runConnections(b, func(pb *testing.PB) {
+			sh := st.shard()
+			for i := 1; pb.Next(); i++ {
+				sh.inFrame(OPCODE_BINARY)
+				if i%1000 == 0 {
+					st.Snapshot()
+				}
+			}
+		})
+	})
+}
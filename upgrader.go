@@ -0,0 +1,89 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Upgrader upgrades connections of standard net/http server,
+// Server provides Config (Handshake, buffers, limits) and Stats.
+type Upgrader struct {
+	Server *Server
+}
+
+// bufferedConn returns data read ahead by http server before reading the socket
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.r.Read(b)
+}
+
+func (bc *bufferedConn) NetConn() net.Conn {
+	return bc.Conn
+}
+
+// Upgrade hijacks http connection and performs websocket handshake.
+// On success it returns connection and handler returned by Config.Handshake,
+// caller is responsible for closing connection.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, req *http.Request) (*Connection, HandlerFunc, error) {
+	s := u.Server
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket: connection can not be hijacked", http.StatusInternalServerError)
+		s.Stats.handshakeFailed()
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, "websocket: "+err.Error(), http.StatusInternalServerError)
+		s.Stats.handshakeFailed()
+		return nil, nil, err
+	}
+	// reset timeouts of http server
+	conn.SetDeadline(time.Time{})
+
+	wsc := &Connection{
+		id:       nextConnectionID(),
+		server:   s,
+		config:   s.Config,
+		stats:    s.Stats,
+		conn:     conn,
+		LogLevel: s.Config.LogLevel,
+		logger:   s.Config.Logger,
+	}
+	wsc.setupSocket()
+	if n := brw.Reader.Buffered(); n > 0 {
+		b, _ := brw.Reader.Peek(n)
+		wsc.conn = &bufferedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(append([]byte(nil), b...)), conn)}
+	}
+	wsc.setupSource()
+	wsc.LogDebug("connection established")
+	wsc.stats.connect()
+
+	handler, err := wsc.handshake(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return wsc, handler, nil
+}
+
+// ServeHTTP upgrades connection and runs handler in the current goroutine
+func (u *Upgrader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	wsc, handler, err := u.Upgrade(w, req)
+	if err != nil {
+		return
+	}
+	detached := false
+	defer func() {
+		if !detached {
+			wsc.finish(recover())
+		}
+	}()
+	detached = wsc.run(handler)
+}
@@ -0,0 +1,51 @@
+package websocket
+
+import (
+	"unicode/utf8"
+)
+
+// utf8Validator validates text message by chunks,
+// incomplete rune at the end of chunk is kept until the next one
+type utf8Validator struct {
+	pending [utf8.UTFMax]byte
+	n       int
+}
+
+func (v *utf8Validator) feed(b []byte) bool {
+	if v.n > 0 {
+		for len(b) > 0 && !utf8.FullRune(v.pending[:v.n]) {
+			v.pending[v.n] = b[0]
+			v.n++
+			b = b[1:]
+		}
+		if !utf8.FullRune(v.pending[:v.n]) {
+			return true
+		}
+		if r, size := utf8.DecodeRune(v.pending[:v.n]); r == utf8.RuneError && size == 1 {
+			return false
+		}
+		v.n = 0
+	}
+	// look for start of the last rune
+	cut := len(b)
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	if !utf8.Valid(b[:cut]) {
+		return false
+	}
+	v.n = copy(v.pending[:], b[cut:])
+	return true
+}
+
+// finish checks that message doesn't end in the middle of rune and resets validator
+func (v *utf8Validator) finish() bool {
+	ok := v.n == 0
+	v.n = 0
+	return ok
+}
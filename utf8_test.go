@@ -0,0 +1,93 @@
+package websocket
+
+import (
+	"fmt"
+	"testing"
+	"unicode/utf8"
+)
+
+var utf8Tests = []struct {
+	text  string
+	valid bool
+}{
+	{"", true},
+	{"hello", true},
+	{"héllo wörld", true},
+	{"€uro", true},
+	{"😀 emoji 😀", true},
+	{"κόσμε\U0010FFFF", true},
+	{"\xc3", false},                 // truncated 2 byte rune
+	{"ab\xe2\x82", false},           // truncated 3 byte rune
+	{"\xf0\x9f\x98", false},         // truncated 4 byte rune
+	{"a\x80b", false},               // unexpected continuation byte
+	{"\xff", false},                 // never valid
+	{"\xc0\xaf", false},             // overlong encoding
+	{"\xe0\x80\xaf", false},         // overlong encoding
+	{"\xed\xa0\x80", false},         // surrogate half
+	{"\xf4\x90\x80\x80", false},     // above U+10FFFF
+	{"\xe2\x82\xe2\x82\xac", false}, // rune cut by another one
+	{"ok\xf0\x9f\x98\x80\xc3(", false},
+}
+
+// feedChunks validates text split into chunks at cuts
+func feedChunks(v *utf8Validator, text string, cuts ...int) bool {
+	prev := 0
+	for _, cut := range append(cuts, len(text)) {
+		if !v.feed([]byte(text[prev:cut])) {
+			v.finish()
+			return false
+		}
+		prev = cut
+	}
+	return v.finish()
+}
+
+func TestUTF8Validator(t *testing.T) {
+	for _, tt := range utf8Tests {
+		if utf8.ValidString(tt.text) != tt.valid {
+			t.Fatalf("%q: bad test case", tt.text)
+		}
+		t.Run(fmt.Sprintf("%q", tt.text), func(t *testing.T) {
+			var v utf8Validator
+			if ok := feedChunks(&v, tt.text); ok != tt.valid {
+				t.Errorf("whole: %v, %v expected", ok, tt.valid)
+			}
+			for i := 0; i <= len(tt.text); i++ {
+				if ok := feedChunks(&v, tt.text, i); ok != tt.valid {
+					t.Errorf("split at %d: %v, %v expected", i, ok, tt.valid)
+				}
+				for j := i; j <= len(tt.text); j++ {
+					if ok := feedChunks(&v, tt.text, i, j); ok != tt.valid {
+						t.Errorf("split at %d, %d: %v, %v expected", i, j, ok, tt.valid)
+					}
+				}
+			}
+			cuts := make([]int, 0, len(tt.text))
+			for i := 1; i < len(tt.text); i++ {
+				cuts = append(cuts, i)
+			}
+			if ok := feedChunks(&v, tt.text, cuts...); ok != tt.valid {
+				t.Errorf("byte by byte: %v, %v expected", ok, tt.valid)
+			}
+		})
+	}
+}
+
+func TestUTF8ValidatorReset(t *testing.T) {
+	var v utf8Validator
+	// message ends in the middle of rune
+	if !v.feed([]byte("\xe2\x82")) {
+		t.Fatal("incomplete rune is rejected before the end")
+	}
+	if v.finish() {
+		t.Fatal("incomplete rune is accepted at the end")
+	}
+	// the rest of the rune starts the next message
+	if v.feed([]byte("\xac")) {
+		t.Error("state of previous message is kept after finish")
+	}
+	v.finish()
+	if !v.feed([]byte("€")) || !v.finish() {
+		t.Error("valid message is rejected after reset")
+	}
+}